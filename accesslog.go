@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+const (
+	accessLogQueueSize     = 4096
+	accessLogFlushInterval = time.Second
+	defaultAccessLogKeyMax = 64
+)
+
+// AccessLogConfig enables logging requests as JSON lines.
+type AccessLogConfig struct {
+	// Defaults to stderr.
+	File string `json:"file"`
+	// Percentage of the requests logged. Defaults to 100.
+	Rate float64 `json:"rate"`
+	// How keys are logged: "raw", "truncate" to KeyMax bytes or "hash".
+	Key    string `json:"key"`
+	KeyMax int    `json:"key_max"`
+}
+
+func (ac *AccessLogConfig) validate() error {
+	switch ac.Key {
+	case "", "raw", "truncate", "hash":
+	default:
+		return fmt.Errorf("access log: unknown key mode %q", ac.Key)
+	}
+	if ac.Rate < 0 || ac.Rate > 100 {
+		return fmt.Errorf("access log: rate %v out of range", ac.Rate)
+	}
+	return nil
+}
+
+type accessEntry struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Pool    string    `json:"pool"`
+	Cmd     string    `json:"cmd"`
+	Key     string    `json:"key"`
+	Size    int       `json:"size"`
+	Status  string    `json:"status"`
+	Backend string    `json:"backend"`
+	Latency float64   `json:"latency_ms"`
+	Opaque  uint32    `json:"opaque"`
+}
+
+// AccessLog writes a sample of the requests as JSON lines. Entries are
+// written by a goroutine of their own and dropped when it can not keep
+// up, so logging never stalls a connection.
+type AccessLog struct {
+	rate   float64
+	key    string
+	keyMax int
+
+	// Held for reading while queueing and for writing while closing.
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan *accessEntry
+	dropped uint64
+	w       *bufio.Writer
+	done    chan struct{}
+}
+
+func NewAccessLog(ac *AccessLogConfig, w io.Writer) *AccessLog {
+	l := &AccessLog{
+		rate:   ac.Rate / 100,
+		key:    ac.Key,
+		keyMax: ac.KeyMax,
+		queue:  make(chan *accessEntry, accessLogQueueSize),
+		w:      bufio.NewWriter(w),
+		done:   make(chan struct{}),
+	}
+	if ac.Rate == 0 {
+		l.rate = 1
+	}
+	if l.keyMax <= 0 {
+		l.keyMax = defaultAccessLogKeyMax
+	}
+	go l.run()
+	return l
+}
+
+// Dropped returns the number of entries dropped because the writer was
+// behind.
+func (l *AccessLog) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Close writes the queued entries and stops the writer.
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mu.Unlock()
+	<-l.done
+	return nil
+}
+
+func (l *AccessLog) record(client, pool string, c *call, rsp *response, latency time.Duration) {
+	if l.rate < 1 && rand.Float64() >= l.rate {
+		return
+	}
+	size := c.size
+	if c.opcode.IsRetrieval() {
+		size = len(rsp.value)
+	}
+	e := &accessEntry{
+		Time:    time.Now(),
+		Client:  client,
+		Pool:    pool,
+		Cmd:     c.opcode.String(),
+		Key:     l.formatKey(c.key),
+		Size:    size,
+		Status:  rsp.status.String(),
+		Backend: c.backend,
+		Latency: float64(latency) / float64(time.Millisecond),
+		Opaque:  c.opaque,
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.queue <- e:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+func (l *AccessLog) formatKey(key []byte) string {
+	switch l.key {
+	case "hash":
+		return hashKey(key)
+	case "truncate":
+		if len(key) > l.keyMax {
+			key = key[:l.keyMax]
+		}
+	}
+	return string(key)
+}
+
+func (l *AccessLog) run() {
+	defer close(l.done)
+	enc := json.NewEncoder(l.w)
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-l.queue:
+			if !ok {
+				l.flush()
+				return
+			}
+			if err := enc.Encode(e); err != nil {
+				applog.Warningf("Failed to write access log: %s", err)
+			}
+		case <-ticker.C:
+			l.flush()
+		}
+	}
+}
+
+func (l *AccessLog) flush() {
+	if err := l.w.Flush(); err != nil {
+		applog.Warningf("Failed to flush access log: %s", err)
+	}
+}
+
+// hashKey returns a short hex digest of key, for logging keys that must
+// not be disclosed.
+func hashKey(key []byte) string {
+	sum := sha1.Sum(key)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	var buf bytes.Buffer
+	l := NewAccessLog(&AccessLogConfig{Key: "truncate", KeyMax: 4}, &buf)
+	ss := new(ServerList)
+	ss.SetServers([]string{f.Addr()})
+	handler := NewMemcacheHandler(ss)
+	handler.Name = "access"
+	handler.SetAccessLog(l)
+	pc := newConn(t, serveProxy(t, handler))
+	if err := pc.Set("foobar", "baz", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	pc.Get("missing")
+	// Log the previous requests before closing the log.
+	pc.Del("foobar")
+	l.Close()
+
+	var entries []accessEntry
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var e accessEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %s", sc.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("got %d entries, want at least 2", len(entries))
+	}
+	if e := entries[0]; e.Cmd != "set" || e.Key != "foob" || e.Size != 3 || e.Backend != f.Addr() || e.Pool != "access" {
+		t.Errorf("got set entry %+v", e)
+	}
+	if e := entries[1]; e.Cmd != "get" || e.Status != KEY_ENOENT.String() {
+		t.Errorf("got get entry %+v", e)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// Admin serves a JSON API to inspect and change a running proxy:
+//
+//	GET  /pools                          pools and the state of their servers
+//	POST /backends/add?pool=&addr=       add a server to a pool
+//	POST /backends/remove?pool=&addr=    remove a server from a pool
+//	POST /backends/drain?pool=&addr=     close the connections to a server
+//	POST /backends/undrain?pool=&addr=   pool the connections to a server again
+//	GET  /hotkeys                        hottest keys of the pools tracking them
+//	GET  /verbosity, POST /verbosity?level=
+//	POST /reload                         reload the config file
+//	GET  /metrics                        metrics in the Prometheus text format
+type Admin struct {
+	proxy  *Proxy
+	reload func() error
+	mux    *http.ServeMux
+
+	addr string
+	l    net.Listener
+}
+
+func NewAdmin(p *Proxy, reload func() error) *Admin {
+	a := &Admin{
+		proxy:  p,
+		reload: reload,
+		mux:    http.NewServeMux(),
+	}
+	a.handle("/pools", "GET", a.pools)
+	a.handle("/backends/add", "POST", a.addBackend)
+	a.handle("/backends/remove", "POST", a.removeBackend)
+	a.handle("/backends/drain", "POST", a.drainBackend)
+	a.handle("/backends/undrain", "POST", a.undrainBackend)
+	a.handle("/hotkeys", "GET", a.hotKeys)
+	a.handle("/verbosity", "", a.verbosity)
+	a.handle("/reload", "POST", a.reloadConfig)
+	a.mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.WriteMetrics(w)
+	})
+	return a
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// handle routes path to f, which returns the value to reply with as JSON.
+// Requests with another method than method are refused, unless it is
+// empty.
+func (a *Admin) handle(path, method string, f func(r *http.Request) (interface{}, error)) {
+	a.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if method != "" && r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(adminError{"Method " + r.Method + " not allowed"})
+			return
+		}
+		v, err := f(r)
+		if err != nil {
+			applog.Warningf("Admin %s %s: %s", r.Method, r.URL, err)
+			w.WriteHeader(http.StatusBadRequest)
+			v = adminError{err.Error()}
+		}
+		json.NewEncoder(w).Encode(v)
+	})
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminOK struct {
+	OK bool `json:"ok"`
+}
+
+// Listen serves the API on addr in the background.
+func (a *Admin) Listen(addr string) (err error) {
+	a.addr = addr
+	if a.l, err = inheritedListener(addr); a.l == nil && err == nil {
+		a.l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	go http.Serve(a.l, a)
+	return nil
+}
+
+func (a *Admin) Close() error {
+	if a.l == nil {
+		return nil
+	}
+	return a.l.Close()
+}
+
+func (a *Admin) listenAddr() string {
+	return a.addr
+}
+
+func (a *Admin) listenerFile() (*os.File, error) {
+	return dupListener(a.l)
+}
+
+type poolStatus struct {
+	Name      string          `json:"name"`
+	Hash      string          `json:"hash"`
+	Discovery string          `json:"discovery,omitempty"`
+	Backends  []backendStatus `json:"backends"`
+}
+
+type backendStatus struct {
+	Addr   string `json:"addr"`
+	Idle   int    `json:"idle"`
+	Active int    `json:"active"`
+	// The connections are closed when released, until the server is
+	// undrained.
+	Draining bool `json:"draining"`
+	// Healthy if the last attempt to connect succeeded. Servers are
+	// never ejected.
+	Healthy     bool   `json:"healthy"`
+	Failures    int    `json:"connect_failures"`
+	LastError   string `json:"last_error,omitempty"`
+	LastFailure string `json:"last_failure,omitempty"`
+}
+
+func (a *Admin) pools(r *http.Request) (interface{}, error) {
+	p := a.proxy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := p.poolNames()
+	pools := make([]poolStatus, 0, len(names))
+	for _, name := range names {
+		pc := p.cfg.Pools[name]
+		ps := poolStatus{
+			Name:     name,
+			Hash:     pc.Hash,
+			Backends: make([]backendStatus, 0, len(pc.Servers)),
+		}
+		if pc.Discovery != nil {
+			ps.Discovery = pc.Discovery.name()
+		}
+		// The selector has the servers of the pool in order.
+		client := p.clients[name]
+		for i, addr := range client.Servers() {
+			st := client.Stats(addr)
+			bs := backendStatus{
+				Addr:     pc.Servers[i],
+				Idle:     st.Idle,
+				Active:   st.Active,
+				Draining: st.Drained,
+				Healthy:  st.Failures == 0,
+				Failures: st.Failures,
+			}
+			if st.LastError != nil {
+				bs.LastError = st.LastError.Error()
+				bs.LastFailure = st.LastFail.Format(time.RFC3339)
+			}
+			ps.Backends = append(ps.Backends, bs)
+		}
+		pools = append(pools, ps)
+	}
+	return pools, nil
+}
+
+// backendParams returns the pool and server of a request, with the index
+// of the server in the pool or -1.
+func (a *Admin) backendParams(r *http.Request) (pool *PoolConfig, name, addr string, i int, err error) {
+	name, addr = r.FormValue("pool"), r.FormValue("addr")
+	pool, ok := a.proxy.cfg.Pools[name]
+	if !ok {
+		return nil, "", "", -1, fmt.Errorf("Unknown pool %q", name)
+	}
+	if addr == "" {
+		return nil, "", "", -1, fmt.Errorf("Missing addr")
+	}
+	for i, server := range pool.Servers {
+		if server == addr {
+			return pool, name, addr, i, nil
+		}
+	}
+	return pool, name, addr, -1, nil
+}
+
+func (a *Admin) addBackend(r *http.Request) (interface{}, error) {
+	p := a.proxy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, name, addr, i, err := a.backendParams(r)
+	if err != nil {
+		return nil, err
+	}
+	if pool.Discovery != nil {
+		return nil, fmt.Errorf("Pool %s uses discovery", name)
+	}
+	if i >= 0 {
+		return nil, fmt.Errorf("Pool %s already has %s", name, addr)
+	}
+	servers := append(append([]string(nil), pool.Servers...), addr)
+	if err = p.setServersLocked(name, servers); err != nil {
+		return nil, err
+	}
+	return adminOK{true}, nil
+}
+
+func (a *Admin) removeBackend(r *http.Request) (interface{}, error) {
+	p := a.proxy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, name, addr, i, err := a.backendParams(r)
+	if err != nil {
+		return nil, err
+	}
+	if pool.Discovery != nil {
+		return nil, fmt.Errorf("Pool %s uses discovery", name)
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("Pool %s has no %s", name, addr)
+	}
+	if len(pool.Servers) == 1 {
+		return nil, fmt.Errorf("Can not remove the last server of pool %s", name)
+	}
+	servers := append(append([]string(nil), pool.Servers[:i]...), pool.Servers[i+1:]...)
+	if err = p.setServersLocked(name, servers); err != nil {
+		return nil, err
+	}
+	return adminOK{true}, nil
+}
+
+func (a *Admin) drainBackend(r *http.Request) (interface{}, error) {
+	p := a.proxy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, name, addr, i, err := a.backendParams(r)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("Pool %s has no %s", name, addr)
+	}
+	client := p.clients[name]
+	client.Drain(client.Servers()[i])
+	applog.Infof("pool %s: drain %s", name, addr)
+	return adminOK{true}, nil
+}
+
+func (a *Admin) undrainBackend(r *http.Request) (interface{}, error) {
+	p := a.proxy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, name, addr, i, err := a.backendParams(r)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("Pool %s has no %s", name, addr)
+	}
+	client := p.clients[name]
+	client.Undrain(client.Servers()[i])
+	applog.Infof("pool %s: undrain %s", name, addr)
+	return adminOK{true}, nil
+}
+
+type hotKeysStatus struct {
+	Pool     string              `json:"pool"`
+	Keys     []HotKey            `json:"keys"`
+	Backends map[string][]HotKey `json:"backends"`
+}
+
+func (a *Admin) hotKeys(r *http.Request) (interface{}, error) {
+	p := a.proxy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pools := []hotKeysStatus{}
+	for _, name := range p.poolNames() {
+		h, ok := p.handlers[name]
+		if !ok || h.hotKeys == nil {
+			continue
+		}
+		keys, backends := h.hotKeys.Top()
+		pools = append(pools, hotKeysStatus{name, keys, backends})
+	}
+	return pools, nil
+}
+
+type verbosityStatus struct {
+	Level int `json:"level"`
+}
+
+func (a *Admin) verbosity(r *http.Request) (interface{}, error) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		level, err := strconv.Atoi(r.FormValue("level"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid level: %s", err)
+		}
+		setVerbose(level)
+		applog.Infof("Set verbosity to %d", level)
+	default:
+		return nil, fmt.Errorf("Method %s not allowed", r.Method)
+	}
+	return verbosityStatus{verboseLevel()}, nil
+}
+
+func (a *Admin) reloadConfig(r *http.Request) (interface{}, error) {
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return adminOK{true}, nil
+}
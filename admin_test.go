@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, a *Admin, method, url string, v interface{}) int {
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	if v != nil {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %s", method, url, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAdmin(t *testing.T) {
+	f1 := newFakeMemcached(t)
+	defer f1.Close()
+	f2 := newFakeMemcached(t)
+	defer f2.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "a"}},
+		Pools:     map[string]*PoolConfig{"a": {Servers: []string{f1.Addr()}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	reloads := 0
+	a := NewAdmin(p, func() error {
+		reloads++
+		return nil
+	})
+
+	cn, err := p.clients["a"].PickConn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.release()
+
+	var pools []poolStatus
+	adminRequest(t, a, "GET", "/pools", &pools)
+	if len(pools) != 1 || len(pools[0].Backends) != 1 {
+		t.Fatalf("got pools %+v", pools)
+	}
+	if b := pools[0].Backends[0]; b.Idle != 1 || b.Active != 1 || !b.Healthy {
+		t.Errorf("got backend %+v, want 1 idle healthy connection", b)
+	}
+
+	if code := adminRequest(t, a, "POST", "/backends/add?pool=a&addr="+f2.Addr(), nil); code != http.StatusOK {
+		t.Errorf("add: got status %d", code)
+	}
+	if code := adminRequest(t, a, "POST", "/backends/remove?pool=a&addr="+f1.Addr(), nil); code != http.StatusOK {
+		t.Errorf("remove: got status %d", code)
+	}
+	var e adminError
+	if code := adminRequest(t, a, "POST", "/backends/remove?pool=a&addr="+f2.Addr(), &e); code != http.StatusBadRequest {
+		t.Errorf("removing the last server: got status %d", code)
+	}
+	if !strings.Contains(e.Error, "last server") {
+		t.Errorf("got error %q", e.Error)
+	}
+	adminRequest(t, a, "GET", "/pools", &pools)
+	if b := pools[0].Backends; len(b) != 1 || b[0].Addr != f2.Addr() {
+		t.Errorf("got backends %+v, want %s", b, f2.Addr())
+	}
+
+	// A drained server stays drained while it is used, until undrained.
+	adminRequest(t, a, "POST", "/backends/drain?pool=a&addr="+f2.Addr(), nil)
+	if cn, err = p.clients["a"].PickConn(""); err != nil {
+		t.Fatal(err)
+	}
+	cn.release()
+	adminRequest(t, a, "GET", "/pools", &pools)
+	if b := pools[0].Backends[0]; !b.Draining || b.Idle != 0 {
+		t.Errorf("got backend %+v, want it draining without idle connections", b)
+	}
+	adminRequest(t, a, "POST", "/backends/undrain?pool=a&addr="+f2.Addr(), nil)
+	adminRequest(t, a, "GET", "/pools", &pools)
+	if b := pools[0].Backends[0]; b.Draining {
+		t.Errorf("got backend %+v, want it undrained", b)
+	}
+
+	var v verbosityStatus
+	adminRequest(t, a, "POST", "/verbosity?level=2", &v)
+	defer setVerbose(verbose)
+	if v.Level != 2 || verboseLevel() != 2 {
+		t.Errorf("got verbosity %d, want 2", v.Level)
+	}
+
+	if code := adminRequest(t, a, "GET", "/reload", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /reload: got status %d", code)
+	}
+	adminRequest(t, a, "POST", "/reload", nil)
+	if reloads != 1 {
+		t.Errorf("got %d reloads, want 1", reloads)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+)
+
+var (
+	saslMechs         = []byte("PLAIN")
+	saslAuthenticated = []byte("Authenticated")
+)
+
+// Auth requires clients to authenticate with SASL PLAIN before sending
+// any other command.
+type Auth struct {
+	// Passwords by user name.
+	Users map[string]string
+}
+
+// serve answers the SASL request req on c, or refuses any other request
+// if c is not authenticated yet.
+func (a *Auth) serve(c *Conn, req *request) *response {
+	rsp := new(response)
+	rsp.init(req.opcode)
+	switch req.opcode {
+	case SASL_LIST_MECHS:
+		rsp.value = saslMechs
+	case SASL_AUTH:
+		if !bytes.Equal(req.key, saslMechs) {
+			rsp.status = AUTH_ERROR
+		} else if user, ok := a.plain(req.value); ok {
+			c.user = user
+			rsp.value = saslAuthenticated
+		} else {
+			rsp.status = AUTH_ERROR
+		}
+	default:
+		rsp.status = AUTH_ERROR
+	}
+	return rsp
+}
+
+// plain checks a PLAIN message: [authzid] NUL authcid NUL passwd.
+func (a *Auth) plain(msg []byte) (user string, ok bool) {
+	parts := bytes.Split(msg, []byte{0})
+	if len(parts) != 3 {
+		return "", false
+	}
+	user = string(parts[1])
+	passwd, found := a.Users[user]
+	if !found || subtle.ConstantTimeCompare([]byte(passwd), parts[2]) != 1 {
+		return "", false
+	}
+	return user, true
+}
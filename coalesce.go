@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// Coalescer merges the retrievals of a key that are sent to a server while
+// another one is in flight: a single request is sent and its response is
+// copied to each of them.
+type Coalescer struct {
+	pool   string
+	client *Client
+
+	mu sync.Mutex
+	// Flights by key, then by server.
+	flights map[string]map[string]*flight
+}
+
+// flight is a retrieval sent on behalf of all the calls waiting for it.
+// rsp and err are set once done is closed.
+type flight struct {
+	done chan struct{}
+	rsp  response
+	err  error
+}
+
+// NewCoalescer coalesces the retrievals sent to the servers of client.
+// pool names them in metrics.
+func NewCoalescer(pool string, client *Client) *Coalescer {
+	return &Coalescer{
+		pool:    pool,
+		client:  client,
+		flights: make(map[string]map[string]*flight),
+	}
+}
+
+// send joins the flight of the key of req to addr, starting it if there
+// is none, and records it in c.
+func (g *Coalescer) send(addr net.Addr, req *request, c *call) error {
+	c.backend = addr.String()
+	key := string(req.key)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.flights[key][c.backend]
+	if !ok {
+		if g.flights[key] == nil {
+			g.flights[key] = make(map[string]*flight)
+		}
+		f = &flight{done: make(chan struct{})}
+		g.flights[key][c.backend] = f
+		go g.fly(f, addr, &request{opcode: req.opcode, key: c.key})
+	} else {
+		coalescedTotal.add(1, g.pool, c.backend)
+	}
+	c.flight = f
+	return nil
+}
+
+func (g *Coalescer) fly(f *flight, addr net.Addr, req *request) {
+	f.err = g.client.roundTripTo(addr, req, &f.rsp)
+	// Retrievals sent from now on see a fresh value.
+	g.mu.Lock()
+	g.removeLocked(string(req.key), addr.String(), f)
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// forget keeps the retrievals of key sent from now on out of the flights
+// already started, which may have been answered before a write of key.
+func (g *Coalescer) forget(key []byte) {
+	g.mu.Lock()
+	delete(g.flights, string(key))
+	g.mu.Unlock()
+}
+
+func (g *Coalescer) removeLocked(key, addr string, f *flight) {
+	flights := g.flights[key]
+	if flights[addr] != f {
+		return
+	}
+	if delete(flights, addr); len(flights) == 0 {
+		delete(g.flights, key)
+	}
+}
+
+// receive waits for the response of the flight and copies it into rsp as
+// the answer to a retrieval with opcode. The flight's response is shared
+// by all its calls and never modified.
+func (f *flight) receive(opcode CommandCode, rsp *response) error {
+	<-f.done
+	if f.err != nil {
+		return f.err
+	}
+	rsp.init(opcode)
+	rsp.key = append(rsp.key, f.rsp.key...)
+	rsp.flags = f.rsp.flags
+	rsp.bytes = f.rsp.bytes
+	rsp.cas = f.rsp.cas
+	rsp.value = append(rsp.value, f.rsp.value...)
+	rsp.status = f.rsp.status
+	return nil
+}
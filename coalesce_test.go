@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/mc"
+)
+
+func TestCoalesce(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "coalesce"}},
+		Pools:     map[string]*PoolConfig{"coalesce": {Servers: []string{f.Addr()}, Coalesce: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	addr := serveProxy(t, p.handlers["coalesce"])
+	if err = newConn(t, addr).Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the server while the retrievals pile up.
+	const n = 10
+	gets := f.Gets()
+	coalesced := coalescedTotal.with("coalesce", f.Addr())
+	f.mu.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(pc *mc.Conn) {
+			defer wg.Done()
+			if val, _, _, err := pc.Get("foo"); err != nil || val != "bar" {
+				t.Errorf("got %q, %v", val, err)
+			}
+		}(newConn(t, addr))
+	}
+	for i := 0; i < 1000 && atomic.LoadUint64(coalesced) < n-1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	f.mu.Unlock()
+	wg.Wait()
+
+	if got := atomic.LoadUint64(coalesced); got != n-1 {
+		t.Errorf("coalesced %d gets, want %d", got, n-1)
+	}
+	if got := f.Gets() - gets; got != 1 {
+		t.Errorf("sent %d gets, want 1", got)
+	}
+}
+
+func TestCoalesceWrite(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	client := newPoolClient(t, f.Addr(), DefaultPoolOptions)
+	defer client.Close()
+	g := NewCoalescer("coalesce", client)
+	addr, err := client.pickServer("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() *call {
+		c := &call{opcode: GET, key: []byte("foo")}
+		if err := g.send(addr, &request{opcode: GET, key: c.key}, c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// A retrieval sent after a write does not join a flight started
+	// before it.
+	f.mu.Lock()
+	before := get()
+	g.forget([]byte("foo"))
+	after, again := get(), get()
+	f.mu.Unlock()
+	if after.flight == before.flight {
+		t.Error("retrieval joined a flight started before a write")
+	}
+	if again.flight != after.flight {
+		t.Error("retrievals after the write were not coalesced")
+	}
+	var rsp response
+	for _, c := range []*call{before, after, again} {
+		if err := c.flight.receive(GET, &rsp); err != nil || rsp.status != KEY_ENOENT {
+			t.Errorf("got %s, %v, want %s", rsp.status, err, KEY_ENOENT)
+		}
+	}
+	if len(g.flights) != 0 {
+		t.Errorf("%d keys left in flight", len(g.flights))
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration written as a string such as "100ms" in
+// configuration files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Failed to parse duration %s: expected a string", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config describes the listeners of a proxy and the named pools they
+// forward to. Zero values fall back to the defaults set on the command
+// line.
+type Config struct {
+	Listeners []*ListenerConfig      `json:"listeners"`
+	Pools     map[string]*PoolConfig `json:"pools"`
+	// Address of the admin API, if any.
+	Admin     string           `json:"admin"`
+	SlowLog   *SlowLogConfig   `json:"slow_log"`
+	AccessLog *AccessLogConfig `json:"access_log"`
+	// Limits the client connections of all listeners.
+	ConnLimits *ConnLimitsConfig `json:"conn_limits"`
+}
+
+// ListenerConfig is an address clients connect to and the pool serving
+// them.
+type ListenerConfig struct {
+	Addr string `json:"addr"`
+	Pool string `json:"pool"`
+	// Only the binary protocol is supported.
+	Protocol     string   `json:"protocol"`
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+	IdleTimeout  Duration `json:"idle_timeout"`
+	// Passwords by user name. Clients must authenticate with SASL PLAIN
+	// if set, unless they present a TLS client certificate.
+	Users map[string]string `json:"users"`
+	TLS   *ServerTLSConfig  `json:"tls"`
+	// Permissions of the socket file if Addr is a unix socket: a path
+	// containing a "/". Addresses starting with "@" are abstract sockets
+	// on Linux.
+	Socket *UnixSocketConfig `json:"socket"`
+}
+
+// PoolConfig is a group of servers and how requests are routed to them.
+// Other pools are referred to by name.
+type PoolConfig struct {
+	Servers         []string            `json:"servers"`
+	Hash            string              `json:"hash"`
+	ConnectTimeout  Duration            `json:"connect_timeout"`
+	ReadTimeout     Duration            `json:"read_timeout"`
+	WriteTimeout    Duration            `json:"write_timeout"`
+	CommandTimeouts map[string]Duration `json:"command_timeouts"`
+	MaxIdle         int                 `json:"max_idle"`
+	MaxActive       int                 `json:"max_active"`
+	PoolWait        Duration            `json:"pool_wait"`
+	IdleTimeout     Duration            `json:"idle_timeout"`
+	Mux             int                 `json:"mux"`
+	// Send a single request for the concurrent retrievals of a key.
+	Coalesce bool `json:"coalesce"`
+	// Replaces Servers with the ones found in DNS.
+	Discovery *DiscoveryConfig `json:"discovery"`
+	// Connects to the servers over TLS.
+	TLS *ClientTLSConfig `json:"tls"`
+
+	Fallback    []string `json:"fallback"`
+	Replicas    []string `json:"replicas"`
+	Ack         string   `json:"ack"`
+	Shadow      string   `json:"shadow"`
+	ShadowRate  float64  `json:"shadow_rate"`
+	ShadowLog   string   `json:"shadow_log"`
+	MigrateFrom string   `json:"migrate_from"`
+	MigrateTTL  int      `json:"migrate_ttl"`
+
+	// Number of hottest keys reported, 0 to not track them. Their counts
+	// are halved every HotKeysWindow.
+	HotKeys       int      `json:"hot_keys"`
+	HotKeysWindow Duration `json:"hot_keys_window"`
+	// Serves the hot keys from the proxy.
+	HotCache *HotCacheConfig `json:"hot_cache"`
+	// Answers repeated retrievals of missing keys from the proxy.
+	NegativeCache *NegativeCacheConfig `json:"negative_cache"`
+	RateLimits    *RateLimitsConfig    `json:"rate_limits"`
+}
+
+// LoadConfig reads a JSON configuration file.
+func LoadConfig(name string) (*Config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := new(Config)
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", name, err)
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %s", name, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that the listeners and pools are complete and that the
+// pools they refer to exist.
+func (cfg *Config) Validate() error {
+	if len(cfg.Listeners) == 0 {
+		return fmt.Errorf("no listeners")
+	}
+	if cfg.AccessLog != nil {
+		if err := cfg.AccessLog.validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.ConnLimits != nil {
+		if err := cfg.ConnLimits.validate(); err != nil {
+			return err
+		}
+	}
+	addrs := make(map[string]bool)
+	for _, lc := range cfg.Listeners {
+		if lc.Addr == "" {
+			return fmt.Errorf("listener without addr")
+		}
+		if addrs[lc.Addr] {
+			return fmt.Errorf("listener %s: duplicate addr", lc.Addr)
+		}
+		addrs[lc.Addr] = true
+		if lc.Protocol != "" && lc.Protocol != "binary" {
+			return fmt.Errorf("listener %s: unsupported protocol %q", lc.Addr, lc.Protocol)
+		}
+		if _, ok := cfg.Pools[lc.Pool]; !ok {
+			return fmt.Errorf("listener %s: unknown pool %q", lc.Addr, lc.Pool)
+		}
+		if lc.TLS != nil {
+			if err := lc.TLS.validate(); err != nil {
+				return fmt.Errorf("listener %s: %s", lc.Addr, err)
+			}
+		}
+		if err := validateUnixAddr(lc.Addr, lc.Socket); err != nil {
+			return fmt.Errorf("listener %s: %s", lc.Addr, err)
+		}
+	}
+
+	for name, pc := range cfg.Pools {
+		if len(pc.Servers) == 0 && pc.Discovery == nil {
+			return fmt.Errorf("pool %s: no servers", name)
+		}
+		if pc.Discovery != nil {
+			if err := pc.Discovery.validate(); err != nil {
+				return fmt.Errorf("pool %s: %s", name, err)
+			}
+		}
+		if pc.TLS != nil {
+			if err := pc.TLS.validate(pc.Servers); err != nil {
+				return fmt.Errorf("pool %s: %s", name, err)
+			}
+		}
+		if _, err := NewSelector(pc.Hash); err != nil {
+			return fmt.Errorf("pool %s: %s", name, err)
+		}
+		for cmd := range pc.CommandTimeouts {
+			if _, ok := commandCode(cmd); !ok {
+				return fmt.Errorf("pool %s: unknown command %q", name, cmd)
+			}
+		}
+		if pc.Ack != "" {
+			if _, err := ParseAckMode(pc.Ack); err != nil {
+				return fmt.Errorf("pool %s: %s", name, err)
+			}
+		}
+		if pc.HotKeys < 0 {
+			return fmt.Errorf("pool %s: negative hot_keys", name)
+		}
+		if pc.HotCache != nil {
+			if pc.HotKeys == 0 {
+				return fmt.Errorf("pool %s: hot_cache needs hot_keys", name)
+			}
+			if err := pc.HotCache.validate(); err != nil {
+				return fmt.Errorf("pool %s: %s", name, err)
+			}
+		}
+		if pc.NegativeCache != nil {
+			if err := pc.NegativeCache.validate(); err != nil {
+				return fmt.Errorf("pool %s: %s", name, err)
+			}
+		}
+		if pc.RateLimits != nil {
+			if err := pc.RateLimits.validate(); err != nil {
+				return fmt.Errorf("pool %s: %s", name, err)
+			}
+		}
+		if len(pc.Replicas) > 0 && pc.MigrateFrom != "" {
+			return fmt.Errorf("pool %s: replicas can not be used while migrating", name)
+		}
+
+		refs := append(append([]string(nil), pc.Fallback...), pc.Replicas...)
+		if pc.Shadow != "" {
+			refs = append(refs, pc.Shadow)
+		}
+		if pc.MigrateFrom != "" {
+			refs = append(refs, pc.MigrateFrom)
+		}
+		for _, ref := range refs {
+			if ref == name {
+				return fmt.Errorf("pool %s: refers to itself", name)
+			}
+			if _, ok := cfg.Pools[ref]; !ok {
+				return fmt.Errorf("pool %s: unknown pool %q", name, ref)
+			}
+		}
+	}
+	return nil
+}
+
+// commandCode returns the opcode of a command name such as "get". Quiet
+// variants share the name, so all of them are returned.
+func commandCode(name string) (opcodes []CommandCode, ok bool) {
+	for opcode, n := range CommandNames {
+		if n == name {
+			opcodes = append(opcodes, opcode)
+		}
+	}
+	return opcodes, len(opcodes) > 0
+}
+
+// newClient returns a client for the pool, with unset options taken from
+// DefaultTimeouts and DefaultPoolOptions.
+func (pc *PoolConfig) newClient() (*Client, error) {
+	ss, err := NewSelector(pc.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if err = ss.SetServers(pc.Servers); err != nil {
+		return nil, err
+	}
+
+	opts := DefaultPoolOptions
+	if pc.MaxIdle != 0 {
+		opts.MaxIdle = pc.MaxIdle
+	}
+	if pc.MaxActive != 0 {
+		opts.MaxActive = pc.MaxActive
+	}
+	if pc.PoolWait != 0 {
+		opts.WaitTimeout = time.Duration(pc.PoolWait)
+	}
+	if pc.IdleTimeout != 0 {
+		opts.IdleTimeout = time.Duration(pc.IdleTimeout)
+	}
+	client := NewClient(ss, opts)
+	if pc.TLS != nil {
+		if client.TLSConfig, err = newClientTLS(pc.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	if pc.ConnectTimeout != 0 {
+		client.Timeouts.Connect = time.Duration(pc.ConnectTimeout)
+	}
+	if pc.ReadTimeout != 0 {
+		client.Timeouts.Read = time.Duration(pc.ReadTimeout)
+	}
+	if pc.WriteTimeout != 0 {
+		client.Timeouts.Write = time.Duration(pc.WriteTimeout)
+	}
+	if len(pc.CommandTimeouts) > 0 {
+		cmds := make(map[CommandCode]time.Duration)
+		for opcode, d := range DefaultTimeouts.Commands {
+			cmds[opcode] = d
+		}
+		for name, d := range pc.CommandTimeouts {
+			opcodes, _ := commandCode(name)
+			for _, opcode := range opcodes {
+				cmds[opcode] = time.Duration(d)
+			}
+		}
+		client.Timeouts.Commands = cmds
+	}
+	return client, nil
+}
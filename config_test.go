@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	f, err := ioutil.TempFile("", "mproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	name := writeConfig(t, `{
+		"listeners": [
+			{"addr": "127.0.0.1:0", "pool": "main", "idle_timeout": "1m"},
+			{"addr": "/tmp/mproxy.sock", "pool": "main"}
+		],
+		"pools": {
+			"main": {
+				"servers": ["127.0.0.1:11211", "127.0.0.1:11212"],
+				"hash": "ketama",
+				"read_timeout": "50ms",
+				"command_timeouts": {"get": "10ms"},
+				"fallback": ["backup"]
+			},
+			"backup": {"servers": ["127.0.0.1:11213"]}
+		}
+	}`)
+	defer os.Remove(name)
+
+	cfg, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cfg.Listeners); n != 2 {
+		t.Fatalf("got %d listeners, want 2", n)
+	}
+	if d := time.Duration(cfg.Listeners[0].IdleTimeout); d != time.Minute {
+		t.Errorf("got idle timeout %v, want 1m", d)
+	}
+
+	client, err := cfg.Pools["main"].newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.selector.(*KetamaList); !ok {
+		t.Errorf("got selector %T, want *KetamaList", client.selector)
+	}
+	if d := client.readTimeout(GET); d != 10*time.Millisecond {
+		t.Errorf("got get timeout %v, want 10ms", d)
+	}
+	if d := client.readTimeout(SET); d != 50*time.Millisecond {
+		t.Errorf("got set timeout %v, want 50ms", d)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{`{"listeners": [{"addr": ":1", "pool": "x"}], "pools": {}}`, `unknown pool "x"`},
+		{`{"listeners": [{"addr": ":1", "pool": "a"}], "pools": {"a": {"servers": ["h:1"], "fallback": ["b"]}}}`, `unknown pool "b"`},
+		{`{"listeners": [{"addr": ":1", "pool": "a"}], "pools": {"a": {"servers": ["h:1"], "hash": "crc"}}}`, `Unknown hash`},
+		{`{"listeners": [{"addr": ":1", "pool": "a", "protocol": "ascii"}], "pools": {"a": {"servers": ["h:1"]}}}`, `unsupported protocol`},
+		{`{"listeners": [{"addr": ":1", "pool": "a"}], "pools": {"a": {"servers": ["h:1"], "timeout": "1s"}}}`, `unknown field`},
+		{`{"listeners": [{"addr": ":1", "pool": "a"}], "pools": {"a": {"servers": ["/tmp/m.sock"], "tls": {}}}}`, `unix socket /tmp/m.sock not supported`},
+		{`{"listeners": [{"addr": ":1", "pool": "a", "socket": {"mode": "0660"}}], "pools": {"a": {"servers": ["h:1"]}}}`, `need a unix socket`},
+		{`{"listeners": [{"addr": "/tmp/m.sock", "pool": "a", "socket": {"mode": "0999"}}], "pools": {"a": {"servers": ["h:1"]}}}`, `invalid mode`},
+	}
+	for _, test := range tests {
+		name := writeConfig(t, test.data)
+		_, err := LoadConfig(name)
+		os.Remove(name)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.data, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// ConnLimitsConfig limits the client connections open on all listeners.
+type ConnLimitsConfig struct {
+	// 0 for no limit.
+	MaxConns      int `json:"max_conns"`
+	MaxConnsPerIP int `json:"max_conns_per_ip"`
+	// What to do beyond MaxConns: "reject" answers new connections with
+	// EBUSY and closes them, "block" stops accepting until a connection
+	// closes. Connections beyond MaxConnsPerIP are always rejected.
+	// Defaults to "reject".
+	Mode string `json:"mode"`
+}
+
+func (cc *ConnLimitsConfig) validate() error {
+	switch cc.Mode {
+	case "", "reject", "block":
+	default:
+		return fmt.Errorf("conn limits: unknown mode %q", cc.Mode)
+	}
+	if cc.MaxConns < 0 || cc.MaxConnsPerIP < 0 {
+		return fmt.Errorf("conn limits: negative limit")
+	}
+	if cc.Mode == "block" && cc.MaxConns == 0 {
+		return fmt.Errorf("conn limits: block mode needs max_conns")
+	}
+	return nil
+}
+
+// ConnLimiter counts the client connections of one or more servers.
+type ConnLimiter struct {
+	max, maxPerIP int
+	block         bool
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+	// Signaled when a connection is released.
+	released chan struct{}
+}
+
+func NewConnLimiter(cc *ConnLimitsConfig) *ConnLimiter {
+	return &ConnLimiter{
+		max:      cc.MaxConns,
+		maxPerIP: cc.MaxConnsPerIP,
+		block:    cc.Mode == "block",
+		perIP:    make(map[string]int),
+		released: make(chan struct{}, 1),
+	}
+}
+
+// wait blocks until a connection can be accepted, in block mode, or stop
+// returns true.
+func (l *ConnLimiter) wait(stop func() bool) {
+	if !l.block {
+		return
+	}
+	warned := false
+	for !stop() {
+		l.mu.Lock()
+		full := l.total >= l.max
+		l.mu.Unlock()
+		if !full {
+			return
+		}
+		if !warned {
+			applog.Warningf("Reached %d client connections, stop accepting", l.max)
+			acceptPausesTotal.add(1)
+			warned = true
+		}
+		select {
+		case <-l.released:
+		case <-time.After(shutdownPollInterval):
+		}
+	}
+}
+
+// acquire counts a connection from addr. If a limit is reached, it returns
+// which one instead.
+func (l *ConnLimiter) acquire(addr string) (limit string) {
+	ip := remoteIP(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return "global"
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return "ip"
+	}
+	l.total++
+	l.perIP[ip]++
+	return ""
+}
+
+func (l *ConnLimiter) release(addr string) {
+	ip := remoteIP(addr)
+	l.mu.Lock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] == 0 {
+		delete(l.perIP, ip)
+	}
+	l.mu.Unlock()
+	select {
+	case l.released <- struct{}{}:
+	default:
+	}
+}
+
+// remoteIP returns the host of a client address, or the address itself if
+// it has no port as with unix sockets.
+func remoteIP(addr string) string {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ip
+}
+
+func (c *Conn) releaseLimit() {
+	if c.limited {
+		c.server.Limiter.release(c.remoteAddr)
+		c.limited = false
+	}
+}
+
+// How long a rejected connection is given to take its answer.
+const rejectTimeout = time.Second
+
+// reject answers a connection beyond the limits with EBUSY and closes it.
+// Connections over TLS are closed without an answer, which would wait for
+// the client to complete the handshake.
+func (c *Conn) reject(limit string) {
+	applog.Warningf("Reject connection from %s: too many connections (%s)", c.remoteAddr, limit)
+	connRejectsTotal.add(1, c.server.Addr, limit)
+	if _, ok := c.rwc.(*tls.Conn); !ok {
+		c.rwc.SetDeadline(time.Now().Add(rejectTimeout))
+		var rsp response
+		rsp.init(GET)
+		rsp.status = EBUSY
+		if err := rsp.WriteTo(c); err == nil {
+			c.Flush()
+		}
+	}
+	c.close()
+}
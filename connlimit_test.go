@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveLimited(t *testing.T, backend string, cc *ConnLimitsConfig) (*Server, string) {
+	ss := new(ServerList)
+	ss.SetServers([]string{backend})
+	srv := &Server{
+		Addr:    "127.0.0.1:0",
+		Handler: NewMemcacheHandler(ss),
+		Limiter: NewConnLimiter(cc),
+	}
+	l, err := srv.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Addr = l.Addr().String()
+	go srv.serve(l)
+	return srv, srv.Addr
+}
+
+func shutdown(srv *Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
+
+func TestConnLimitReject(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+	srv, addr := serveLimited(t, f.Addr(), &ConnLimitsConfig{MaxConns: 1})
+	defer shutdown(srv)
+
+	pc := newConn(t, addr)
+	if err := pc.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	var hdr [HDR_LEN]byte
+	if _, err = io.ReadFull(nc, hdr[:]); err != nil {
+		t.Fatalf("Failed to read rejection: %s", err)
+	}
+	if status := Status(binary.BigEndian.Uint16(hdr[6:])); status != EBUSY {
+		t.Errorf("got status %s, want %s", status, EBUSY)
+	}
+	if n := atomic.LoadUint64(connRejectsTotal.with(addr, "global")); n != 1 {
+		t.Errorf("got %d rejects, want 1", n)
+	}
+}
+
+func TestConnLimitBlock(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+	srv, addr := serveLimited(t, f.Addr(), &ConnLimitsConfig{MaxConns: 1, Mode: "block"})
+	defer shutdown(srv)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && srv.numConns() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The second connection waits in the backlog until the first closes.
+	done := make(chan error, 1)
+	go func() {
+		done <- newConn(t, addr).Set("foo", "bar", 0, 0, 0)
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("served a connection beyond the limit: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	nc.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted after another closed")
+	}
+}
+
+func TestConnLimitRejectTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "proxy")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeMemcached(t)
+	defer f.Close()
+	ss := new(ServerList)
+	ss.SetServers([]string{f.Addr()})
+	srv := &Server{
+		Addr:      "127.0.0.1:0",
+		Handler:   NewMemcacheHandler(ss),
+		Limiter:   NewConnLimiter(&ConnLimitsConfig{MaxConns: 1}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	l, err := srv.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve(l)
+	defer shutdown(srv)
+
+	held, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	for i := 0; i < 100 && srv.numConns() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A connection beyond the limit that never starts the handshake is
+	// closed at once.
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetReadDeadline(time.Now().Add(time.Second))
+	var b [1]byte
+	if _, err = nc.Read(b[:]); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
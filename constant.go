@@ -39,7 +39,12 @@ const (
 	FLUSHQ     = CommandCode(0x18)
 	APPENDQ    = CommandCode(0x19)
 	PREPENDQ   = CommandCode(0x1a)
-	UNKNOWN    = CommandCode(0xff)
+
+	SASL_LIST_MECHS = CommandCode(0x20)
+	SASL_AUTH       = CommandCode(0x21)
+	SASL_STEP       = CommandCode(0x22)
+
+	UNKNOWN = CommandCode(0xff)
 )
 
 type Status uint16
@@ -101,6 +106,9 @@ func init() {
 	CommandNames[FLUSHQ] = "flush"
 	CommandNames[APPENDQ] = "append"
 	CommandNames[PREPENDQ] = "prepend"
+	CommandNames[SASL_LIST_MECHS] = "sasl_list_mechs"
+	CommandNames[SASL_AUTH] = "sasl_auth"
+	CommandNames[SASL_STEP] = "sasl_step"
 
 	StatusNames = make(map[Status]string)
 	StatusNames[SUCCESS] = "No error"
@@ -158,3 +166,21 @@ func (o CommandCode) IsQuiet() bool {
 	}
 	return false
 }
+
+// Return true if a command retrieves a value.
+func (o CommandCode) IsRetrieval() bool {
+	switch o {
+	case GET, GETQ, GETK, GETKQ:
+		return true
+	}
+	return false
+}
+
+// Return true if a command is part of SASL authentication.
+func (o CommandCode) IsSASL() bool {
+	switch o {
+	case SASL_LIST_MECHS, SASL_AUTH, SASL_STEP:
+		return true
+	}
+	return false
+}
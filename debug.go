@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/hex"
 	"io"
+	"sync/atomic"
 
 	"git.jumbo.ws/go/tcgl/applog"
 )
@@ -21,6 +22,26 @@ func NewVerboseReadWriter(r io.ReadWriter) *verboseReadWriter {
 	return &verboseReadWriter{r}
 }
 
+// The verbosity level in effect. It can be changed at runtime.
+var verbosity int32 = 3
+
+func setVerbose(level int) {
+	atomic.StoreInt32(&verbosity, int32(level))
+	applog.SetLevel(level)
+}
+
+func verboseLevel() int {
+	return int(atomic.LoadInt32(&verbosity))
+}
+
+// wrapVerbose dumps all traffic on rw when running at the debug level.
+func wrapVerbose(rw ReadWriter) ReadWriter {
+	if verboseLevel() == 0 {
+		return NewVerboseReadWriter(rw)
+	}
+	return rw
+}
+
 func (rw *verboseReadWriter) Read(p []byte) (n int, err error) {
 	if n, err = rw.ReadWriter.Read(p); err == nil {
 		applog.Debugf("\n%s", hex.Dump(p[:n]))
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// DiscoveryConfig finds the servers of a pool in DNS, either from the SRV
+// records of a name or from the A records of a host:port.
+type DiscoveryConfig struct {
+	SRV string `json:"srv"`
+	A   string `json:"a"`
+	// How often to resolve the name. Defaults to 30s.
+	Interval Duration `json:"interval"`
+	// How long a new answer must stay the same before it is applied.
+	Debounce Duration `json:"debounce"`
+	// Answers with fewer servers are ignored. Defaults to 1.
+	MinServers int `json:"min_servers"`
+}
+
+const defaultDiscoveryInterval = 30 * time.Second
+
+func (dc *DiscoveryConfig) validate() error {
+	if (dc.SRV == "") == (dc.A == "") {
+		return fmt.Errorf("discovery needs one of srv or a")
+	}
+	if dc.A != "" {
+		if _, _, err := net.SplitHostPort(dc.A); err != nil {
+			return fmt.Errorf("discovery: %s", err)
+		}
+	}
+	if dc.MinServers < 0 {
+		return fmt.Errorf("discovery: negative min_servers")
+	}
+	return nil
+}
+
+func (dc *DiscoveryConfig) name() string {
+	if dc.SRV != "" {
+		return "srv " + dc.SRV
+	}
+	return "a " + dc.A
+}
+
+// lookup resolves the servers, sorted.
+func (dc *DiscoveryConfig) lookup(ctx context.Context) ([]string, error) {
+	var servers []string
+	if dc.SRV != "" {
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", dc.SRV)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			servers = append(servers, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	} else {
+		host, port, _ := net.SplitHostPort(dc.A)
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			servers = append(servers, net.JoinHostPort(addr, port))
+		}
+	}
+	sort.Strings(servers)
+	return servers, nil
+}
+
+// Discovery polls DNS for the servers of a pool and passes changes to
+// apply. Answers that are too small or that do not last for the debounce
+// time are ignored, so a transient DNS failure does not empty the pool.
+type Discovery struct {
+	name       string
+	lookup     func(ctx context.Context) ([]string, error)
+	apply      func(servers []string) error
+	interval   time.Duration
+	debounce   time.Duration
+	minServers int
+
+	current      []string
+	pending      []string
+	pendingSince time.Time
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewDiscovery(dc *DiscoveryConfig, apply func(servers []string) error) *Discovery {
+	d := &Discovery{
+		name:       dc.name(),
+		lookup:     dc.lookup,
+		apply:      apply,
+		interval:   time.Duration(dc.Interval),
+		debounce:   time.Duration(dc.Debounce),
+		minServers: dc.MinServers,
+		quit:       make(chan struct{}),
+	}
+	if d.interval <= 0 {
+		d.interval = defaultDiscoveryInterval
+	}
+	if d.minServers == 0 {
+		d.minServers = 1
+	}
+	return d
+}
+
+// Start resolves the servers once, applying them without waiting for the
+// debounce time, then keeps polling in the background.
+func (d *Discovery) Start() {
+	if servers, ok := d.resolve(); ok {
+		d.update(servers)
+	}
+	go d.run()
+}
+
+// Close stops polling.
+func (d *Discovery) Close() error {
+	d.closeOnce.Do(func() { close(d.quit) })
+	return nil
+}
+
+func (d *Discovery) run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.poll(now)
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// resolve looks the servers up, returning false if the answer must be
+// ignored.
+func (d *Discovery) resolve() ([]string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.interval)
+	defer cancel()
+	servers, err := d.lookup(ctx)
+	if err != nil {
+		applog.Warningf("Failed to resolve %s: %s", d.name, err)
+		return nil, false
+	}
+	if len(servers) < d.minServers {
+		applog.Warningf("Ignore %d servers from %s (min %d)", len(servers), d.name, d.minServers)
+		return nil, false
+	}
+	return servers, true
+}
+
+func (d *Discovery) poll(now time.Time) {
+	servers, ok := d.resolve()
+	if !ok || reflect.DeepEqual(servers, d.current) {
+		d.pending = nil
+		return
+	}
+	if !reflect.DeepEqual(servers, d.pending) {
+		d.pending, d.pendingSince = servers, now
+	}
+	if now.Sub(d.pendingSince) >= d.debounce {
+		d.update(servers)
+	}
+}
+
+func (d *Discovery) update(servers []string) {
+	if err := d.apply(servers); err != nil {
+		applog.Errorf("Failed to apply servers from %s: %s", d.name, err)
+		return
+	}
+	d.current, d.pending = servers, nil
+}
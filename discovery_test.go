@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiscovery(t *testing.T) {
+	var answer []string
+	var applied [][]string
+	d := NewDiscovery(&DiscoveryConfig{
+		A:          "memcached:11211",
+		Debounce:   Duration(10 * time.Second),
+		MinServers: 2,
+	}, func(servers []string) error {
+		applied = append(applied, servers)
+		return nil
+	})
+	d.lookup = func(ctx context.Context) ([]string, error) {
+		return answer, nil
+	}
+
+	answer = []string{"10.0.0.1:11211", "10.0.0.2:11211"}
+	d.Start()
+	defer d.Close()
+	if len(applied) != 1 {
+		t.Fatalf("got %d updates after start, want 1", len(applied))
+	}
+
+	now := time.Now()
+	steps := []struct {
+		answer  []string
+		after   time.Duration
+		applied int
+	}{
+		// Too few servers.
+		{[]string{"10.0.0.1:11211"}, 0, 1},
+		{nil, 20 * time.Second, 1},
+		// A new server must be seen for the debounce time.
+		{[]string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}, 30 * time.Second, 1},
+		{[]string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}, 35 * time.Second, 1},
+		{[]string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}, 40 * time.Second, 2},
+		// A flapping answer is never applied.
+		{[]string{"10.0.0.1:11211", "10.0.0.2:11211"}, 50 * time.Second, 2},
+		{[]string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}, 55 * time.Second, 2},
+		{[]string{"10.0.0.1:11211", "10.0.0.2:11211"}, 60 * time.Second, 2},
+	}
+	for i, step := range steps {
+		answer = step.answer
+		d.poll(now.Add(step.after))
+		if len(applied) != step.applied {
+			t.Fatalf("step %d: got %d updates, want %d", i, len(applied), step.applied)
+		}
+	}
+	if last := applied[len(applied)-1]; !reflect.DeepEqual(last, steps[4].answer) {
+		t.Errorf("got servers %q, want %q", last, steps[4].answer)
+	}
+}
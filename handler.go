@@ -2,106 +2,638 @@ package main
 
 import (
 	"io"
+	"net"
+	"sync"
 	"time"
 
 	"git.jumbo.ws/go/tcgl/applog"
 )
 
 type MemcacheHandler struct {
-	client *Client
+	// Name of the pool in metrics.
+	Name      string
+	client    *Client
+	fallbacks []*Client
+	replicas  *ReplicaSet
+	shadow    *Shadow
+	migration *Migration
+	mux       *Mux
+	slowLog   *SlowLog
+	accessLog *AccessLog
+	hotKeys   *HotKeys
+	cache     *HotCache
+	misses    *NegativeCache
+	coalescer *Coalescer
+	limits    *RateLimits
 }
 
 func NewMemcacheHandler(ss ServerSelector) *MemcacheHandler {
+	return NewHandler(NewFromSelector(ss))
+}
+
+// NewHandler returns a handler forwarding requests to the pool of client.
+func NewHandler(client *Client) *MemcacheHandler {
 	return &MemcacheHandler{
-		client: NewFromSelector(ss),
+		client: client,
 	}
 }
 
-func (h *MemcacheHandler) Serve(c *Conn) (err error) {
-	remote, err := h.client.PickConn("")
+// SetFallback makes the handler retry retrievals on the pool of client
+// when the primary server fails to answer them.
+func (h *MemcacheHandler) SetFallback(client *Client) {
+	h.fallbacks = append(h.fallbacks, client)
+}
+
+// SetReplicas fans every write out to the replicas as well as the local
+// pool and answers it once ack is satisfied. Retrievals fall back to the
+// replicas in order.
+func (h *MemcacheHandler) SetReplicas(ack AckMode, replicas []*Replica) {
+	local := NewReplica("local", h.client)
+	h.replicas = NewReplicaSet(ack, append([]*Replica{local}, replicas...))
+	for _, r := range replicas {
+		h.fallbacks = append(h.fallbacks, r.client)
+	}
+}
+
+// SetShadow mirrors a sample of the requests to the shadow pool.
+func (h *MemcacheHandler) SetShadow(s *Shadow) {
+	h.shadow = s
+}
+
+// SetMigration migrates from the pool of old to the local pool. Writes are
+// answered once both pools have, so this replaces any replicas.
+func (h *MemcacheHandler) SetMigration(old *Client, ttl int) {
+	h.replicas = NewReplicaSet(AckAll, []*Replica{
+		NewReplica("local", h.client),
+		NewReplica("old", old),
+	})
+	h.migration = &Migration{
+		old:   old,
+		local: h.client,
+		TTL:   ttl,
+	}
+}
+
+// SetSlowLog logs the requests slower than the threshold of s.
+func (h *MemcacheHandler) SetSlowLog(s *SlowLog) {
+	h.slowLog = s
+}
+
+// SetAccessLog logs a sample of the requests to l.
+func (h *MemcacheHandler) SetAccessLog(l *AccessLog) {
+	h.accessLog = l
+}
+
+// SetHotKeys counts the requests per key in k.
+func (h *MemcacheHandler) SetHotKeys(k *HotKeys) {
+	h.hotKeys = k
+}
+
+// SetHotCache serves the retrievals of the keys found hot by the hot key
+// tracker from c.
+func (h *MemcacheHandler) SetHotCache(c *HotCache) {
+	h.cache = c
+}
+
+// SetNegativeCache answers the retrievals of the keys just found missing
+// from c.
+func (h *MemcacheHandler) SetNegativeCache(c *NegativeCache) {
+	h.misses = c
+}
+
+// SetRateLimits refuses the requests beyond the limits of rl.
+func (h *MemcacheHandler) SetRateLimits(rl *RateLimits) {
+	h.limits = rl
+}
+
+// SetCoalescing sends a single request for the concurrent retrievals of a
+// key from a server.
+func (h *MemcacheHandler) SetCoalescing() {
+	h.coalescer = NewCoalescer(h.Name, h.client)
+}
+
+// SetMux shares size connections per server between all client
+// connections instead of giving each its own.
+func (h *MemcacheHandler) SetMux(size int) {
+	h.mux = NewMux(h.client, size)
+}
+
+// Close closes the connections to all pools.
+func (h *MemcacheHandler) Close() error {
+	if h.mux != nil {
+		h.mux.Close()
+	}
+	h.client.Close()
+	for _, c := range h.fallbacks {
+		c.Close()
+	}
+	if h.replicas != nil {
+		for _, r := range h.replicas.replicas {
+			r.client.Close()
+		}
+	}
+	if h.shadow != nil {
+		h.shadow.Close()
+		h.shadow.client.Close()
+	}
+	if h.migration != nil {
+		h.migration.old.Close()
+	}
+	if h.hotKeys != nil {
+		h.hotKeys.Close()
+	}
+	return nil
+}
+
+func (h *MemcacheHandler) canFailover(opcode CommandCode) bool {
+	return len(h.fallbacks) > 0 && opcode.IsRetrieval()
+}
+
+// call is a request that has been forwarded and is waiting for its
+// response. Requests pipelined on the client connection's own backend are
+// read from remote, coalesced retrievals from flight. Otherwise the
+// response is delivered in rsp or err once done is closed. If neither is
+// set the request could not be sent and err tells why. shadow is the copy
+// of the request to mirror, if any.
+//
+// start is when the request was read. backend is the server that answered
+// it, sent and received when it was sent to and answered by the backend.
+// The response fills the hot cache with sequence number fillSeq if fill is
+// set, and the negative cache with missSeq if fillMiss is.
+type call struct {
+	opcode   CommandCode
+	opaque   uint32
+	key      []byte
+	size     int
+	remote   *conn
+	flight   *flight
+	rsp      *response
+	err      error
+	done     chan struct{}
+	shadow   *request
+	start    time.Time
+	backend  string
+	sent     time.Time
+	received time.Time
+	fill     bool
+	fillSeq  uint64
+	fillMiss bool
+	missSeq  uint64
+}
+
+// server returns the server of the pool that answered c, or "" if it was
+// answered by the proxy, the replicas or a fallback pool.
+func (c *call) server() string {
+	switch c.backend {
+	case "cache", "local", "replicas", "fallback":
+		return ""
+	}
+	return c.backend
+}
+
+// backendTime returns how long the backend took to answer.
+func (c *call) backendTime() time.Duration {
+	if c.sent.IsZero() || c.received.IsZero() {
+		return 0
+	}
+	return c.received.Sub(c.sent)
+}
+
+// backend holds the server connections a client connection pipelines its
+// requests on, one per server. After an error a connection is discarded
+// and the next request to its server picks a new one.
+type backend struct {
+	client *Client
+	mu     sync.Mutex
+	conns  map[string]*conn
+	// Server picked at random for all keys, if the pool has no hash.
+	pinned net.Addr
+	// Index of the shared connections to each server that requests are
+	// sent on, with a mux.
+	slot int
+	// Replicated writes not yet answered by the local pool.
+	writes sync.WaitGroup
+}
+
+func newBackend(client *Client) *backend {
+	return &backend{
+		client: client,
+		conns:  make(map[string]*conn),
+	}
+}
+
+// server returns the server of key. A server picked at random is kept
+// until its connection fails or it is removed from the pool, so that the
+// client reads its own writes.
+func (b *backend) server(key []byte) (net.Addr, error) {
+	if !b.client.randomServers() {
+		return b.client.pickServer(string(key))
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pinned != nil && !b.client.hasServer(b.pinned) {
+		b.pinned = nil
+	}
+	if b.pinned == nil {
+		addr, err := b.client.pickServer("")
+		if err != nil {
+			return nil, err
+		}
+		b.pinned = addr
+	}
+	return b.pinned, nil
+}
+
+func (b *backend) conn(key []byte) (*conn, error) {
+	addr, err := b.server(key)
 	if err != nil {
-		applog.Errorf("Failed to pick connection: %s", err)
-		return
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cn, ok := b.conns[addr.String()]
+	if !ok {
+		if cn, err = b.client.getConn(addr); err != nil {
+			return nil, err
+		}
+		b.conns[addr.String()] = cn
+	}
+	return cn, nil
+}
+
+func (b *backend) discard(cn *conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conns[cn.addr.String()] == cn {
+		delete(b.conns, cn.addr.String())
+	}
+	if b.pinned != nil && b.pinned.String() == cn.addr.String() {
+		b.pinned = nil
+	}
+	cn.Close()
+}
+
+func (b *backend) condRelease(err *error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, cn := range b.conns {
+		cn.condRelease(err)
+		delete(b.conns, key)
+	}
+}
+
+func (b *backend) send(req *request) (cn *conn, err error) {
+	if cn, err = b.conn(req.key); err != nil {
+		return nil, err
+	}
+	rw := wrapVerbose(cn)
+	if err = req.WriteTo(rw); err != nil {
+		b.discard(cn)
+		return nil, err
+	}
+	start := time.Now()
+	if err = rw.Flush(); err != nil {
+		delta := time.Now().Sub(start)
+		applog.Warningf("Failed to flush request after %v: %s", delta, err)
+		b.discard(cn)
+		return nil, err
+	}
+	return cn, nil
+}
+
+func (h *MemcacheHandler) Serve(c *Conn) (err error) {
+	b := newBackend(h.client)
+	if h.mux != nil {
+		b.slot = h.mux.slot()
 	}
 	defer func() {
-		remote.condRelease(&err)
+		b.condRelease(&err)
 	}()
 
-	var clientConn ReadWriter = c
-	var serverConn ReadWriter = remote
-	if verbose == 0 {
-		clientConn = NewVerboseReadWriter(clientConn)
-		serverConn = NewVerboseReadWriter(serverConn)
-	}
+	clientConn := wrapVerbose(newCountingReadWriter(c, h.Name))
 
-	requests := make(chan CommandCode, 256)
-	c1 := make(chan error)
-	c2 := make(chan error)
+	calls := make(chan *call, 256)
+	done := make(chan struct{})
+	defer close(done)
+	c1 := make(chan error, 1)
+	c2 := make(chan error, 1)
 
-	go h.serveRequest(clientConn, serverConn, requests, c1)
-	go h.serveResponse(serverConn, clientConn, requests, c2)
+	go h.serveRequest(c, clientConn, b, calls, done, c1)
+	go h.serveResponse(c.remoteAddr, b, clientConn, calls, c2)
 
 	select {
 	case err = <-c1:
+		if err == nil {
+			// The client is done sending, wait for the pending responses.
+			err = <-c2
+		}
 	case err = <-c2:
 	}
 	return
 }
 
-func (h *MemcacheHandler) serveRequest(from, to ReadWriter, requests chan CommandCode, errchan chan error) {
+func (h *MemcacheHandler) serveRequest(c *Conn, from ReadWriter, b *backend, calls chan *call, done chan struct{}, errchan chan error) {
 	var err error
 	defer func() {
+		close(calls)
 		errchan <- err
-		requests <- QUIT
 	}()
 
 	var req request
 	for {
-		if err = req.ReadFrom(from); err != nil && err != io.EOF {
-			applog.Warningf("Failed to read request: %s", err)
+		if !c.awaitRequest() {
 			return
 		}
-		if err = req.WriteTo(to); err != nil {
-			applog.Warningf("Failed to write request: %s", err)
+		if err = req.ReadFrom(from); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !c.started {
+				applog.Debugf("Close idle connection from %s", c.remoteAddr)
+				err = nil
+			} else if err == io.EOF {
+				err = nil
+			} else {
+				applog.Warningf("Failed to read request: %s", err)
+			}
 			return
 		}
-		start := time.Now()
-		if err = to.Flush(); err != nil {
-			delta := time.Now().Sub(start)
-			applog.Warningf("Failed to flush request after %v: %s", delta, err)
-			return
+
+		cl := &call{
+			opcode: req.opcode,
+			opaque: req.opaque,
+			key:    append([]byte(nil), req.key...),
+			size:   len(req.value),
+			start:  time.Now(),
+		}
+		if auth := c.server.Auth; auth != nil && (req.opcode.IsSASL() || c.user == "") {
+			cl.reply(auth.serve(c, &req))
+		} else if rsp := h.throttle(c, &req); rsp != nil {
+			cl.reply(rsp)
+		} else if rsp := h.lookup(&req, cl); rsp != nil {
+			cl.reply(rsp)
+			cl.backend = "cache"
+		} else {
+			// Only the requests sent to the pool are mirrored.
+			if h.shadow != nil && h.shadow.sample() {
+				cl.shadow = req.clone()
+			}
+			if err = h.forward(b, &req, cl); err != nil {
+				if !h.canFailover(req.opcode) {
+					applog.Warningf("Failed to write request: %s", err)
+					return
+				}
+				applog.Warningf("Failed to write request, using fallback: %s", err)
+				cl.err = err
+				err = nil
+			}
 		}
 
-		requests <- req.opcode
+		select {
+		case calls <- cl:
+		case <-done:
+			return
+		}
 	}
 }
 
-func (h *MemcacheHandler) serveResponse(from, to ReadWriter, requests chan CommandCode, errchan chan error) {
+func (h *MemcacheHandler) serveResponse(client string, b *backend, to ReadWriter, calls chan *call, errchan chan error) {
 	var err error
 	defer func() {
 		errchan <- err
 	}()
 
-	var rsp response
-	for {
-		select {
-		case req := <-requests:
-			if req == QUIT {
-				return
-			}
-			rsp.init(req)
-			start := time.Now()
-			if err = rsp.ReadFrom(from); err != nil {
-				delta := time.Now().Sub(start)
-				applog.Warningf("Failed to read response after %v: %s", delta, err)
-				return
-			}
-			if err = rsp.WriteTo(to); err != nil {
-				return
-			}
-			if err = to.Flush(); err != nil {
-				return
-			}
+	var buf response
+	metrics := newRequestMetrics(h.Name)
+	for c := range calls {
+		var rsp *response
+		if rsp, err = h.receive(b, c, &buf); err != nil {
+			return
+		}
+		if h.migration != nil && c.opcode.IsRetrieval() && rsp.status == KEY_ENOENT {
+			h.migration.readThrough(b, c, rsp)
+			c.received = time.Now()
+		}
+		h.updateCaches(c, rsp)
+		if err = rsp.WriteTo(to); err != nil {
+			return
+		}
+		if err = to.Flush(); err != nil {
+			return
+		}
+		total := time.Since(c.start)
+		metrics.observe(c, rsp, total)
+		if h.slowLog != nil {
+			h.slowLog.record(h.Name, c, rsp, total)
+		}
+		if h.accessLog != nil {
+			h.accessLog.record(client, h.Name, c, rsp, total)
+		}
+		if h.hotKeys != nil {
+			h.hotKeys.record(c.server(), c.key)
+		}
+		if c.shadow != nil {
+			h.shadow.mirror(c.shadow, rsp)
+		}
+	}
+}
+
+// throttle returns the response refusing req if it exceeds a rate limit.
+func (h *MemcacheHandler) throttle(c *Conn, req *request) *response {
+	if h.limits == nil {
+		return nil
+	}
+	status, limit := h.limits.check(c, req.key, time.Now())
+	if status == SUCCESS {
+		return nil
+	}
+	throttledTotal.add(1, h.Name, limit)
+	rsp := new(response)
+	rsp.init(req.opcode)
+	rsp.status = status
+	return rsp
+}
+
+// lookup returns the cached response to req if it is a retrieval of a key
+// just found missing or of a hot key, or marks c to fill the caches with
+// its response. Other requests invalidate the cached responses for their
+// key, flushes all of them.
+func (h *MemcacheHandler) lookup(req *request, c *call) *response {
+	if h.cache == nil && h.misses == nil {
+		return nil
+	}
+	now := time.Now()
+	if !req.opcode.IsRetrieval() {
+		h.invalidate(req.opcode, req.key, now)
+		return nil
+	}
+	if len(req.key) == 0 {
+		return nil
+	}
+	if h.misses != nil {
+		if rsp, ok := h.misses.get(req.opcode, c.key, now); ok {
+			negativeCacheHits.add(1, h.Name)
+			return rsp
+		}
+		c.fillMiss = true
+		c.missSeq = h.misses.startFill()
+	}
+	if h.cache != nil {
+		if rsp, ok := h.cache.get(req.opcode, c.key, now); ok {
+			hotCacheHits.add(1, h.Name)
+			return rsp
+		}
+		if h.hotKeys.requests(req.key) >= h.cache.minRequests {
+			hotCacheMisses.add(1, h.Name)
+			c.fill = true
+			c.fillSeq = h.cache.startFill()
+		}
+	}
+	return nil
+}
+
+// updateCaches fills the caches with the response to c if it is marked to.
+// A write invalidates the caches again once answered: retrievals sent
+// since it was read may have been answered before it, and filled them
+// with the old response.
+func (h *MemcacheHandler) updateCaches(c *call, rsp *response) {
+	now := time.Now()
+	if c.fill {
+		h.cache.fill(c.key, c.fillSeq, c.start, rsp, now)
+	}
+	if c.fillMiss {
+		h.misses.fill(c.key, c.missSeq, c.start, rsp, now)
+	}
+	if !c.opcode.IsRetrieval() {
+		h.invalidate(c.opcode, c.key, now)
+	}
+}
+
+// invalidate drops the cached responses for key, written by a request
+// with opcode, or all of them if it is a flush.
+func (h *MemcacheHandler) invalidate(opcode CommandCode, key []byte, now time.Time) {
+	if opcode == FLUSH || opcode == FLUSHQ {
+		if h.misses != nil {
+			h.misses.clear()
+		}
+		if h.cache != nil {
+			h.cache.clear()
+		}
+		return
+	}
+	if len(key) == 0 {
+		return
+	}
+	if h.misses != nil {
+		h.misses.invalidate(key, now)
+	}
+	if h.cache != nil {
+		h.cache.invalidate(key, now)
+	}
+}
+
+// forward sends req on its way and records in c where its response will
+// come from.
+func (h *MemcacheHandler) forward(b *backend, req *request, c *call) (err error) {
+	// Replicated writes are sent on their own connections. The requests
+	// that follow them wait until the local pool has them.
+	b.writes.Wait()
+	c.sent = time.Now()
+	if h.coalescer != nil && !req.opcode.IsRetrieval() {
+		h.coalescer.forget(req.key)
+	}
+	switch {
+	case h.replicas != nil && !req.opcode.IsRetrieval():
+		// The local pool is written on the server the client reads from.
+		var addr net.Addr
+		if addr, err = b.server(req.key); err != nil {
+			return
+		}
+		c.backend = "replicas"
+		c.done = make(chan struct{})
+		b.writes.Add(1)
+		go func(req *request) {
+			c.rsp = h.replicas.Write(req, addr, b.writes.Done)
+			c.received = time.Now()
+			close(c.done)
+		}(req.clone())
+	case h.coalescer != nil && req.opcode.IsRetrieval():
+		var addr net.Addr
+		if addr, err = b.server(req.key); err == nil {
+			err = h.coalescer.send(addr, req, c)
+		}
+	case h.mux != nil:
+		var addr net.Addr
+		if addr, err = b.server(req.key); err == nil {
+			err = h.mux.send(addr, b.slot, req, c)
+		}
+	default:
+		if c.remote, err = b.send(req); err == nil {
+			c.backend = c.remote.addr.String()
+		}
+	}
+	return
+}
+
+// receive returns the response to c, reading it into buf if it is
+// pipelined on the client connection's backend. Retrievals that failed are
+// retried on the fallback pools.
+func (h *MemcacheHandler) receive(b *backend, c *call, buf *response) (rsp *response, err error) {
+	switch {
+	case c.done != nil:
+		<-c.done
+		rsp, err = c.rsp, c.err
+	case c.flight != nil:
+		rsp = buf
+		err = c.flight.receive(c.opcode, rsp)
+		c.received = time.Now()
+	case c.remote != nil:
+		rsp = buf
+		rsp.init(c.opcode)
+		c.remote.expect(c.opcode)
+		start := time.Now()
+		err = rsp.ReadFrom(wrapVerbose(c.remote))
+		c.received = time.Now()
+		if err != nil {
+			delta := c.received.Sub(start)
+			applog.Warningf("Failed to read response after %v: %s", delta, err)
+			b.discard(c.remote)
+		}
+	default:
+		err = c.err
+	}
+	if err == nil {
+		return rsp, nil
+	}
+	if !h.canFailover(c.opcode) {
+		return nil, err
+	}
+	h.failover(c, buf)
+	return buf, nil
+}
+
+// reply answers c with rsp without forwarding it.
+func (c *call) reply(rsp *response) {
+	c.backend = "local"
+	c.rsp = rsp
+	c.done = make(chan struct{})
+	close(c.done)
+}
+
+// failover retries the retrieval c on the fallback pools in order. If none
+// of them answers it is reported to the client as a miss.
+func (h *MemcacheHandler) failover(c *call, rsp *response) {
+	req := request{opcode: c.opcode, key: c.key}
+	c.backend = "fallback"
+	// Misses are reported when the fallbacks fail too.
+	c.fillMiss = false
+	for _, client := range h.fallbacks {
+		c.sent = time.Now()
+		err := client.roundTrip(&req, rsp)
+		c.received = time.Now()
+		if err == nil {
+			return
 		}
+		applog.Warningf("Failed to read %q from fallback: %s", c.key, err)
 	}
+	rsp.init(c.opcode)
+	rsp.status = KEY_ENOENT
 }
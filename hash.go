@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"sync"
+)
+
+// NewSelector returns a ServerSelector for the named hashing method.
+func NewSelector(hash string) (ServerSelector, error) {
+	switch hash {
+	case "", "random":
+		return new(ServerList), nil
+	case "modula":
+		return new(ModulaList), nil
+	case "ketama":
+		return new(KetamaList), nil
+	}
+	return nil, fmt.Errorf("Unknown hash %q", hash)
+}
+
+// ModulaList picks the server at the crc32 of the key modulo the number of
+// servers.
+type ModulaList struct {
+	mu    sync.Mutex
+	addrs []net.Addr
+}
+
+func (ml *ModulaList) SetServers(servers []string) error {
+	naddr, err := resolveServers(servers)
+	if err != nil {
+		return err
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.addrs = naddr
+	return nil
+}
+
+func (ml *ModulaList) PickServer(key string) (net.Addr, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if len(ml.addrs) == 0 {
+		return nil, ErrNoServers
+	}
+
+	return ml.addrs[crc32.ChecksumIEEE([]byte(key))%uint32(len(ml.addrs))], nil
+}
+
+func (ml *ModulaList) Servers() []net.Addr {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.addrs
+}
+
+// Number of md5 digests per server on a ketama ring. Each digest gives
+// four points.
+const ketamaDigests = 40
+
+type ketamaPoint struct {
+	hash uint32
+	addr net.Addr
+}
+
+// KetamaList picks servers on a ketama consistent hash ring, so that
+// adding or removing a server only moves the keys of its neighbours.
+type KetamaList struct {
+	mu     sync.Mutex
+	addrs  []net.Addr
+	points []ketamaPoint
+}
+
+func (kl *KetamaList) SetServers(servers []string) error {
+	naddr, err := resolveServers(servers)
+	if err != nil {
+		return err
+	}
+
+	points := make([]ketamaPoint, 0, len(naddr)*ketamaDigests*4)
+	for i, addr := range naddr {
+		for d := 0; d < ketamaDigests; d++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", servers[i], d)))
+			for p := 0; p < 4; p++ {
+				points = append(points, ketamaPoint{
+					hash: binary.LittleEndian.Uint32(digest[p*4:]),
+					addr: addr,
+				})
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	kl.addrs = naddr
+	kl.points = points
+	return nil
+}
+
+func (kl *KetamaList) PickServer(key string) (net.Addr, error) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if len(kl.points) == 0 {
+		return nil, ErrNoServers
+	}
+
+	digest := md5.Sum([]byte(key))
+	h := binary.LittleEndian.Uint32(digest[:])
+	i := sort.Search(len(kl.points), func(i int) bool {
+		return kl.points[i].hash >= h
+	})
+	if i == len(kl.points) {
+		i = 0
+	}
+	return kl.points[i].addr, nil
+}
+
+func (kl *KetamaList) Servers() []net.Addr {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	return kl.addrs
+}
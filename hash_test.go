@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKetamaList(t *testing.T) {
+	servers := []string{"127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11213"}
+	kl := new(KetamaList)
+	if err := kl.SetServers(servers); err != nil {
+		t.Fatal(err)
+	}
+
+	picked := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		addr, err := kl.PickServer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[key] = addr.String()
+		counts[addr.String()]++
+	}
+	for _, s := range servers {
+		if n := counts[s]; n < 500 {
+			t.Errorf("%s got %d of 3000 keys", s, n)
+		}
+	}
+
+	// Removing a server only moves its own keys.
+	if err := kl.SetServers(servers[:2]); err != nil {
+		t.Fatal(err)
+	}
+	for key, old := range picked {
+		addr, _ := kl.PickServer(key)
+		if old != servers[2] && addr.String() != old {
+			t.Errorf("%s moved from %s to %s", key, old, addr)
+		}
+	}
+}
+
+func TestModulaList(t *testing.T) {
+	ml := new(ModulaList)
+	if err := ml.SetServers([]string{"127.0.0.1:11211", "127.0.0.1:11212"}); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := ml.PickServer("foo")
+	b, _ := ml.PickServer("foo")
+	if a != b {
+		t.Errorf("foo picked %s then %s", a, b)
+	}
+}
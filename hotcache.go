@@ -0,0 +1,241 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHotCacheTTL         = time.Second
+	defaultHotCacheMaxBytes    = 64 << 20
+	defaultHotCacheMinRequests = 100
+
+	// Bytes accounted for each cached item on top of its key and value.
+	cacheItemOverhead = 64
+	// Writes remembered by a cache within its TTL.
+	maxInvalidations = 100000
+)
+
+// HotCacheConfig caches the values of the hot keys of a pool in the proxy.
+// It needs the pool to track its hot keys.
+type HotCacheConfig struct {
+	// How long values are served from the cache. Defaults to 1s.
+	TTL Duration `json:"ttl"`
+	// Memory used by the cache, least recently used values are evicted
+	// beyond it. Defaults to 64MB.
+	MaxBytes int `json:"max_bytes"`
+	// Requests counted for a key by the hot key tracker before its value
+	// is cached. Defaults to 100.
+	MinRequests uint64 `json:"min_requests"`
+}
+
+func (hc *HotCacheConfig) validate() error {
+	if hc.TTL < 0 {
+		return fmt.Errorf("hot cache: negative ttl")
+	}
+	if hc.MaxBytes < 0 {
+		return fmt.Errorf("hot cache: negative max_bytes")
+	}
+	return nil
+}
+
+type cacheItem struct {
+	key     string
+	flags   int
+	value   []byte
+	expires time.Time
+}
+
+func (it *cacheItem) size() int {
+	return len(it.key) + len(it.value) + cacheItemOverhead
+}
+
+// localCache holds the responses of a status to retrievals for a short
+// time. Writes seen by the proxy invalidate the cached response of their
+// key, and the responses to retrievals sent before such a write are not
+// cached.
+type localCache struct {
+	status   Status
+	ttl      time.Duration
+	maxBytes int
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	bytes int
+	// Incremented by every invalidation. Fills carry the sequence number
+	// of when their retrieval was sent.
+	seq uint64
+	// The last remembered invalidation of keys, forgotten after ttl along
+	// with the fills they could have raced with. Beyond
+	// maxInvalidations, all the fills in flight are refused instead.
+	invalidated map[string]invalidation
+	floor       uint64
+	swept       time.Time
+}
+
+type invalidation struct {
+	seq uint64
+	at  time.Time
+}
+
+func newLocalCache(status Status, ttl time.Duration, maxBytes int) *localCache {
+	return &localCache{
+		status:      status,
+		ttl:         ttl,
+		maxBytes:    maxBytes,
+		lru:         list.New(),
+		items:       make(map[string]*list.Element),
+		invalidated: make(map[string]invalidation),
+	}
+}
+
+// get returns the cached response to a retrieval of key.
+func (c *localCache) get(opcode CommandCode, key []byte, now time.Time) (*response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[string(key)]
+	if !ok {
+		return nil, false
+	}
+	it := e.Value.(*cacheItem)
+	if now.After(it.expires) {
+		c.removeLocked(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+
+	rsp := new(response)
+	rsp.init(opcode)
+	rsp.status = c.status
+	if c.status == SUCCESS {
+		rsp.key = key
+		rsp.flags = it.flags
+		rsp.bytes = len(it.value)
+		// Cached values are never modified, only replaced.
+		rsp.value = it.value
+	}
+	return rsp, true
+}
+
+// startFill returns the sequence number to fill the cache with the
+// response to a retrieval about to be sent.
+func (c *localCache) startFill() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+// fill caches rsp, read by a retrieval of key sent at start with sequence
+// number seq, unless the key was written since.
+func (c *localCache) fill(key []byte, seq uint64, start time.Time, rsp *response, now time.Time) {
+	if rsp.status != c.status || now.Sub(start) >= c.ttl {
+		return
+	}
+	it := &cacheItem{
+		key:     string(key),
+		expires: now.Add(c.ttl),
+	}
+	if c.status == SUCCESS {
+		it.flags = rsp.flags
+		it.value = append([]byte(nil), rsp.value...)
+	}
+	if it.size() > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq < c.floor {
+		return
+	}
+	if inv, ok := c.invalidated[it.key]; ok && inv.seq > seq {
+		return
+	}
+	if e, ok := c.items[it.key]; ok {
+		c.removeLocked(e)
+	}
+	c.items[it.key] = c.lru.PushFront(it)
+	c.bytes += it.size()
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// invalidate drops the cached response for key, which is being written.
+// The write is remembered so that the retrievals sent before it can not
+// cache the old response.
+func (c *localCache) invalidate(key []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	if e, ok := c.items[string(key)]; ok {
+		c.removeLocked(e)
+	}
+	if now.Sub(c.swept) >= c.ttl {
+		for k, inv := range c.invalidated {
+			if now.Sub(inv.at) >= c.ttl {
+				delete(c.invalidated, k)
+			}
+		}
+		c.swept = now
+	}
+	if len(c.invalidated) >= maxInvalidations {
+		c.invalidated = make(map[string]invalidation)
+		c.floor = c.seq
+		return
+	}
+	c.invalidated[string(key)] = invalidation{c.seq, now}
+}
+
+// clear drops all the cached responses, as the servers were flushed, and
+// refuses the fills in flight.
+func (c *localCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+	c.invalidated = make(map[string]invalidation)
+	c.floor = c.seq
+}
+
+func (c *localCache) removeLocked(e *list.Element) {
+	it := c.lru.Remove(e).(*cacheItem)
+	delete(c.items, it.key)
+	c.bytes -= it.size()
+}
+
+// Len returns the number of cached responses and the memory they use.
+func (c *localCache) Len() (items, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items), c.bytes
+}
+
+// HotCache holds the values of hot keys for a short time.
+type HotCache struct {
+	*localCache
+	minRequests uint64
+}
+
+func NewHotCache(hc *HotCacheConfig) *HotCache {
+	ttl, maxBytes := time.Duration(hc.TTL), hc.MaxBytes
+	if ttl == 0 {
+		ttl = defaultHotCacheTTL
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultHotCacheMaxBytes
+	}
+	c := &HotCache{
+		localCache:  newLocalCache(SUCCESS, ttl, maxBytes),
+		minRequests: hc.MinRequests,
+	}
+	if c.minRequests == 0 {
+		c.minRequests = defaultHotCacheMinRequests
+	}
+	return c
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHotCache(t *testing.T) {
+	c := NewHotCache(&HotCacheConfig{TTL: Duration(time.Minute), MaxBytes: 2 * (cacheItemOverhead + 4)})
+	now := time.Now()
+	value := func(v string) *response {
+		return &response{status: SUCCESS, flags: 7, value: []byte(v)}
+	}
+
+	c.fill([]byte("a"), c.startFill(), now, value("aaa"), now)
+	rsp, ok := c.get(GETK, []byte("a"), now)
+	if !ok || string(rsp.value) != "aaa" || rsp.flags != 7 || string(rsp.key) != "a" || rsp.opcode != GETK {
+		t.Fatalf("got %+v, %v", rsp, ok)
+	}
+	if _, ok = c.get(GET, []byte("a"), now.Add(2*time.Minute)); ok {
+		t.Errorf("got an expired value")
+	}
+
+	// A write of a hot key while it is being read keeps the value read
+	// out of the cache.
+	seq := c.startFill()
+	c.invalidate([]byte("b"), now)
+	c.fill([]byte("b"), seq, now, value("bbb"), now)
+	if _, ok = c.get(GET, []byte("b"), now); ok {
+		t.Errorf("cached a value read before it was written")
+	}
+	c.fill([]byte("b"), c.startFill(), now, value("bbb"), now)
+	c.invalidate([]byte("b"), now)
+	if _, ok = c.get(GET, []byte("b"), now); ok {
+		t.Errorf("got an invalidated value")
+	}
+
+	// The least recently used value is evicted.
+	for _, key := range []string{"a", "b", "c"} {
+		c.fill([]byte(key), c.startFill(), now, value(key+key+key), now)
+		if key == "b" {
+			c.get(GET, []byte("a"), now)
+		}
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok = c.get(GET, []byte(key), now); ok != want {
+			t.Errorf("%s cached: %v, want %v", key, ok, want)
+		}
+	}
+	if items, bytes := c.Len(); items != 2 || bytes != 2*(cacheItemOverhead+4) {
+		t.Errorf("got %d items of %d bytes", items, bytes)
+	}
+
+	// A flush empties the cache and keeps out the values read before it.
+	seq = c.startFill()
+	c.clear()
+	c.fill([]byte("d"), seq, now, value("ddd"), now)
+	if items, _ := c.Len(); items != 0 {
+		t.Errorf("got %d items after a flush, want 0", items)
+	}
+	c.fill([]byte("d"), c.startFill(), now, value("ddd"), now)
+	if _, ok = c.get(GET, []byte("d"), now); !ok {
+		t.Errorf("value read after a flush not cached")
+	}
+}
+
+func TestHotCacheWriteRace(t *testing.T) {
+	h := NewHandler(nil)
+	h.SetHotKeys(NewHotKeys(1, time.Hour))
+	defer h.hotKeys.Close()
+	h.SetHotCache(NewHotCache(&HotCacheConfig{TTL: Duration(time.Minute), MinRequests: 1}))
+	key := []byte("foo")
+	h.hotKeys.record("", key)
+
+	// A retrieval read after a write, but answered by the server before
+	// it, does not leave the old value in the cache.
+	set := newStorageRequest(SET, key, []byte("new"), 0, 0)
+	h.lookup(set, &call{opcode: SET, key: key})
+	get := &request{opcode: GET, key: key}
+	c := &call{opcode: GET, key: key, start: time.Now()}
+	if h.lookup(get, c) != nil || !c.fill {
+		t.Fatalf("retrieval of a hot key not marked to fill the cache")
+	}
+	h.updateCaches(c, &response{opcode: GET, status: SUCCESS, value: []byte("old")})
+	h.updateCaches(&call{opcode: SET, key: key}, &response{opcode: SET, status: SUCCESS})
+	if rsp := h.lookup(get, &call{opcode: GET, key: key}); rsp != nil {
+		t.Errorf("got %q cached before a write", rsp.value)
+	}
+}
+
+func TestProxyHotCache(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "hotcache"}},
+		Pools: map[string]*PoolConfig{"hotcache": {
+			Servers:  []string{f.Addr()},
+			HotKeys:  4,
+			HotCache: &HotCacheConfig{TTL: Duration(time.Minute), MinRequests: 2},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pc := newConn(t, serveProxy(t, p.handlers["hotcache"]))
+	if err = pc.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Requests are counted after they are answered, so the first ones are
+	// not cached.
+	for i := 0; i < 5; i++ {
+		pc.Get("foo")
+	}
+	gets := f.Gets()
+	for i := 0; i < 5; i++ {
+		if val, _, _, err := pc.Get("foo"); err != nil || val != "bar" {
+			t.Fatalf("got %q, %v", val, err)
+		}
+	}
+	if n := f.Gets() - gets; n != 0 {
+		t.Errorf("forwarded %d gets of a cached key", n)
+	}
+	if hits := atomic.LoadUint64(hotCacheHits.with("hotcache")); hits < 5 {
+		t.Errorf("got %d hits, want at least 5", hits)
+	}
+
+	if err = pc.Set("foo", "baz", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _, err := pc.Get("foo"); err != nil || val != "baz" {
+		t.Errorf("got %q, %v after set, want baz", val, err)
+	}
+}
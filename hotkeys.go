@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Counters kept per requested top key. Space-saving is exact for the keys
+// much more frequent than the ones it evicts, so it keeps more counters
+// than it reports.
+const topKOverProvision = 8
+
+const defaultHotKeysWindow = 10 * time.Second
+
+// HotKey is a frequently requested key. Count overestimates the requests
+// for the key by at most Error.
+type HotKey struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// topK finds the most frequent keys of a stream with the space-saving
+// algorithm: when all counters are taken, the least frequent key is
+// replaced and the new key inherits its count.
+type topK struct {
+	size    int
+	entries map[string]*topKEntry
+	heap    topKHeap
+}
+
+type topKEntry struct {
+	key   string
+	count uint64
+	err   uint64
+	index int
+}
+
+func newTopK(size int) *topK {
+	return &topK{
+		size:    size,
+		entries: make(map[string]*topKEntry, size),
+	}
+}
+
+func (t *topK) add(key string) {
+	if e, ok := t.entries[key]; ok {
+		e.count++
+		heap.Fix(&t.heap, e.index)
+		return
+	}
+	if len(t.heap) < t.size {
+		e := &topKEntry{key: key, count: 1}
+		t.entries[key] = e
+		heap.Push(&t.heap, e)
+		return
+	}
+	e := t.heap[0]
+	delete(t.entries, e.key)
+	e.key, e.err = key, e.count
+	e.count++
+	t.entries[key] = e
+	heap.Fix(&t.heap, 0)
+}
+
+// top returns the k most frequent keys, most frequent first.
+func (t *topK) top(k int) []HotKey {
+	keys := make([]HotKey, 0, len(t.heap))
+	for _, e := range t.heap {
+		keys = append(keys, HotKey{e.key, e.count, e.err})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Count > keys[j].Count
+	})
+	if len(keys) > k {
+		keys = keys[:k]
+	}
+	return keys
+}
+
+// decay halves the counts so that keys that were hot a while ago make
+// room for the ones hot now.
+func (t *topK) decay() {
+	live := t.heap[:0]
+	for _, e := range t.heap {
+		e.count /= 2
+		e.err /= 2
+		if e.count == 0 {
+			delete(t.entries, e.key)
+			continue
+		}
+		e.index = len(live)
+		live = append(live, e)
+	}
+	t.heap = live
+	heap.Init(&t.heap)
+}
+
+// topKHeap is a min-heap of counts.
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	e := x.(*topKEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// HotKeys tracks the most requested keys of a pool and of each of its
+// servers. Counts are halved every window.
+type HotKeys struct {
+	k int
+
+	mu       sync.Mutex
+	pool     *topK
+	backends map[string]*topK
+
+	quit chan struct{}
+	once sync.Once
+}
+
+func NewHotKeys(k int, window time.Duration) *HotKeys {
+	h := &HotKeys{
+		k:        k,
+		pool:     newTopK(k * topKOverProvision),
+		backends: make(map[string]*topK),
+		quit:     make(chan struct{}),
+	}
+	if window <= 0 {
+		window = defaultHotKeysWindow
+	}
+	go h.run(window)
+	return h
+}
+
+func (h *HotKeys) record(backend string, key []byte) {
+	if len(key) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pool.add(string(key))
+	if backend == "" {
+		return
+	}
+	t, ok := h.backends[backend]
+	if !ok {
+		t = newTopK(h.k * topKOverProvision)
+		h.backends[backend] = t
+	}
+	t.add(string(key))
+}
+
+// requests returns the least number of requests counted for key, 0 if it
+// is not among the hottest.
+func (h *HotKeys) requests(key []byte) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e, ok := h.pool.entries[string(key)]; ok {
+		return e.count - e.err
+	}
+	return 0
+}
+
+// Top returns the hottest keys of the pool and of each server.
+func (h *HotKeys) Top() (pool []HotKey, backends map[string][]HotKey) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	backends = make(map[string][]HotKey, len(h.backends))
+	for backend, t := range h.backends {
+		backends[backend] = t.top(h.k)
+	}
+	return h.pool.top(h.k), backends
+}
+
+// Close stops the decay.
+func (h *HotKeys) Close() error {
+	h.once.Do(func() { close(h.quit) })
+	return nil
+}
+
+func (h *HotKeys) run(window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.quit:
+			return
+		}
+		h.mu.Lock()
+		h.pool.decay()
+		for backend, t := range h.backends {
+			t.decay()
+			if len(t.heap) == 0 {
+				delete(h.backends, backend)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
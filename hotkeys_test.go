@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopK(t *testing.T) {
+	// Space-saving finds the keys requested more than 1/16th of the time.
+	tk := newTopK(16)
+	// Three hot keys among many that are requested once.
+	for i := 0; i < 100; i++ {
+		tk.add("a")
+		if i%2 == 0 {
+			tk.add("b")
+		}
+		if i%4 == 0 {
+			tk.add("c")
+		}
+		tk.add(fmt.Sprintf("cold%d", i))
+	}
+	top := tk.top(3)
+	if len(top) != 3 {
+		t.Fatalf("got %d keys, want 3: %v", len(top), top)
+	}
+	for i, want := range []string{"a", "b", "c"} {
+		if top[i].Key != want {
+			t.Errorf("top[%d] = %v, want %s", i, top[i], want)
+		}
+	}
+	if top[0].Count != 100 || top[0].Error != 0 {
+		t.Errorf("a counted %d (error %d), want 100", top[0].Count, top[0].Error)
+	}
+
+	tk.decay()
+	if top = tk.top(1); top[0].Count != 50 {
+		t.Errorf("a counted %d after decay, want 50", top[0].Count)
+	}
+	for i := 0; i < 10; i++ {
+		tk.decay()
+	}
+	if top = tk.top(3); len(top) != 0 {
+		t.Errorf("got %v after decaying to zero, want none", top)
+	}
+
+	// Keys that survive a decay dropping others can still be counted.
+	tk = newTopK(4)
+	for _, key := range "abbbbcccccc" {
+		tk.add(string(key))
+	}
+	tk.decay()
+	tk.add("c")
+	tk.add("b")
+	tk.add("d")
+	if top = tk.top(3); len(top) != 3 || top[0] != (HotKey{"c", 4, 0}) || top[1] != (HotKey{"b", 3, 0}) {
+		t.Errorf("got %v after decay, want c 4 times and b 3 times", top)
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	h := NewHotKeys(2, time.Hour)
+	defer h.Close()
+	h.record("s1", []byte("foo"))
+	h.record("s1", []byte("foo"))
+	h.record("s2", []byte("bar"))
+	h.record("", nil)
+
+	keys, backends := h.Top()
+	if len(keys) != 2 || keys[0] != (HotKey{"foo", 2, 0}) || keys[1] != (HotKey{"bar", 1, 0}) {
+		t.Errorf("pool keys = %v", keys)
+	}
+	if len(backends) != 2 || backends["s1"][0].Key != "foo" || backends["s2"][0].Key != "bar" {
+		t.Errorf("backend keys = %v", backends)
+	}
+}
+
+func TestProxyHotKeys(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "hot"}},
+		Pools: map[string]*PoolConfig{"hot": {
+			Servers:       []string{f.Addr()},
+			HotKeys:       1,
+			NegativeCache: &NegativeCacheConfig{TTL: Duration(time.Minute)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pc := newConn(t, serveProxy(t, p.handlers["hot"]))
+	if err = pc.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	pc.Get("foo")
+	pc.Get("foo")
+	// Requests are counted after their response is flushed, but before
+	// the next one is answered. The second miss is answered by the proxy,
+	// which is not counted as a backend.
+	pc.Get("bar")
+	pc.Get("bar")
+
+	var pools []hotKeysStatus
+	adminRequest(t, NewAdmin(p, nil), "GET", "/hotkeys", &pools)
+	if len(pools) != 1 || pools[0].Pool != "hot" {
+		t.Fatalf("got %+v", pools)
+	}
+	if keys := pools[0].Keys; len(keys) != 1 || keys[0].Key != "foo" || keys[0].Count != 3 {
+		t.Errorf("got keys %+v, want foo requested 3 times", keys)
+	}
+	if keys := pools[0].Backends[f.Addr()]; len(pools[0].Backends) != 1 || len(keys) != 1 || keys[0].Key != "foo" {
+		t.Errorf("got backend keys %+v", pools[0].Backends)
+	}
+
+	var buf bytes.Buffer
+	p.WriteMetrics(&buf)
+	for _, want := range []string{
+		`mproxy_hot_key_requests{pool="hot",rank="1"} 3`,
+		`mproxy_backend_hot_key_requests{pool="hot",backend="` + f.Addr() + `",rank="1"} 3`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %s in\n%s", want, buf.String())
+		}
+	}
+}
@@ -1,16 +1,46 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
+	"syscall"
+	"time"
 
 	"git.jumbo.ws/go/tcgl/applog"
 )
 
+// commandTimeouts collects name=duration read timeouts of commands.
+type commandTimeouts map[CommandCode]time.Duration
+
+func (ct commandTimeouts) String() string {
+	return fmt.Sprintf("%v", map[CommandCode]time.Duration(ct))
+}
+
+func (ct commandTimeouts) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expected name=duration: %q", value)
+	}
+	d, err := time.ParseDuration(value[i+1:])
+	if err != nil {
+		return err
+	}
+	opcodes, ok := commandCode(value[:i])
+	if !ok {
+		return fmt.Errorf("unknown command %q", value[:i])
+	}
+	for _, opcode := range opcodes {
+		ct[opcode] = d
+	}
+	return nil
+}
+
 type stringSlice []string
 
 func (s *stringSlice) String() string {
@@ -23,17 +53,115 @@ func (s *stringSlice) Set(value string) error {
 }
 
 var (
-	verbose    int
-	local      string
-	remotes    stringSlice
-	cpuprofile string
-	memprofile string
+	configFile      string
+	watchInterval   time.Duration
+	adminAddr       string
+	slowLog         time.Duration
+	slowLogFile     string
+	slowLogHash     bool
+	accessLogFile   string
+	accessLogRate   float64
+	accessLogKey    string
+	hotKeys         int
+	hotKeysWindow   time.Duration
+	hotCacheTTL     time.Duration
+	hotCacheSize    int
+	hotCacheMin     uint64
+	negCacheTTL     time.Duration
+	negCacheSize    int
+	ipRate          float64
+	userRate        float64
+	maxConns        int
+	maxConnsPerIP   int
+	maxConnsMode    string
+	tlsCert         string
+	tlsKey          string
+	tlsClientCA     string
+	socketMode      string
+	socketOwner     string
+	socketGroup     string
+	remoteTLS       bool
+	remoteTLSCA     string
+	remoteTLSCert   string
+	remoteTLSKey    string
+	verbose         int
+	local           string
+	remotes         stringSlice
+	fallbacks       stringSlice
+	replicas        stringSlice
+	ackMode         string
+	shadow          string
+	shadowRate      float64
+	shadowLog       string
+	migrate         string
+	migrateTTL      int
+	muxConns        int
+	coalesce        bool
+	clientIdle      time.Duration
+	clientRead      time.Duration
+	clientWrite     time.Duration
+	shutdownTimeout time.Duration
+	cpuprofile      string
+	memprofile      string
 )
 
 func init() {
+	flag.StringVar(&configFile, "config", "", "read listeners and pools from this JSON file instead of -l and -r")
+	flag.DurationVar(&watchInterval, "watch", 0, "reload the config file when it changes, checking at this interval (0 to disable)")
+	flag.StringVar(&adminAddr, "admin", "", "serve the admin API on this address (overrides the config file)")
+	flag.DurationVar(&slowLog, "slowlog", 0, "log requests slower than this (0 to disable)")
+	flag.StringVar(&slowLogFile, "slowlogfile", "", "write the slow log to this file (default stderr)")
+	flag.BoolVar(&slowLogHash, "slowloghash", false, "log a hash of the keys in the slow log")
+	flag.StringVar(&accessLogFile, "accesslog", "", "write a JSON lines access log to this file (- for stderr)")
+	flag.Float64Var(&accessLogRate, "accesslograte", 100, "percentage of the requests written to the access log")
+	flag.StringVar(&accessLogKey, "accesslogkey", "raw", "how keys are written to the access log: raw, truncate or hash")
+	flag.IntVar(&hotKeys, "hotkeys", 0, "track this many of the most requested keys (0 to disable)")
+	flag.DurationVar(&hotKeysWindow, "hotkeyswindow", 10*time.Second, "halve the hot key counts at this interval")
+	flag.DurationVar(&hotCacheTTL, "hotcachettl", 0, "serve hot keys from the proxy for this long (0 to disable, needs -hotkeys)")
+	flag.IntVar(&hotCacheSize, "hotcachesize", defaultHotCacheMaxBytes, "memory in bytes used by the hot key cache")
+	flag.Uint64Var(&hotCacheMin, "hotcachemin", defaultHotCacheMinRequests, "requests counted for a key before it is cached")
+	flag.DurationVar(&negCacheTTL, "negcachettl", 0, "answer gets of keys found missing from the proxy for this long (0 to disable)")
+	flag.IntVar(&negCacheSize, "negcachesize", defaultNegativeCacheMaxBytes, "memory in bytes used by the negative cache")
+	flag.Float64Var(&ipRate, "iprate", 0, "requests per second accepted from each client IP (0 for no limit)")
+	flag.Float64Var(&userRate, "userrate", 0, "requests per second accepted from each authenticated user (0 for no limit)")
+	flag.IntVar(&maxConns, "maxconns", 0, "maximum number of client connections (0 for no limit)")
+	flag.IntVar(&maxConnsPerIP, "maxconnsperip", 0, "maximum number of client connections from an IP (0 for no limit)")
+	flag.StringVar(&maxConnsMode, "maxconnsmode", "reject", "beyond -maxconns, reject new connections or block accepting")
+	flag.StringVar(&tlsCert, "tlscert", "", "serve clients over TLS with this certificate file")
+	flag.StringVar(&tlsKey, "tlskey", "", "key file of -tlscert")
+	flag.StringVar(&tlsClientCA, "tlsclientca", "", "require client certificates signed by these CAs")
+	flag.StringVar(&socketMode, "socketmode", "", "octal permissions of the -l unix socket")
+	flag.StringVar(&socketOwner, "socketowner", "", "owner of the -l unix socket")
+	flag.StringVar(&socketGroup, "socketgroup", "", "group of the -l unix socket")
+	flag.BoolVar(&remoteTLS, "remotetls", false, "connect to the remotes over TLS")
+	flag.StringVar(&remoteTLSCA, "remotetlsca", "", "verify the remotes' certificates with these CAs (default system CAs)")
+	flag.StringVar(&remoteTLSCert, "remotetlscert", "", "certificate file presented to the remotes")
+	flag.StringVar(&remoteTLSKey, "remotetlskey", "", "key file of -remotetlscert")
 	flag.IntVar(&verbose, "v", 3, "set verbosity level")
 	flag.StringVar(&local, "l", ":8080", "set local address")
 	flag.Var(&remotes, "r", "remote address")
+	flag.Var(&fallbacks, "fallback", "fallback remote address for reads")
+	flag.Var(&replicas, "replica", "comma separated remote addresses of a replica pool")
+	flag.StringVar(&ackMode, "ack", "first", "replicated write acknowledgment: first, quorum or all")
+	flag.StringVar(&shadow, "shadow", "", "comma separated remote addresses of a shadow pool")
+	flag.Float64Var(&shadowRate, "shadowrate", 1, "percentage of requests mirrored to the shadow pool")
+	flag.StringVar(&shadowLog, "shadowlog", "", "write shadow mismatches to this file (default stderr)")
+	flag.StringVar(&migrate, "migrate", "", "comma separated remote addresses of the pool to migrate from")
+	flag.IntVar(&migrateTTL, "migratettl", 3600, "expiration in seconds of items copied from the old pool")
+	flag.IntVar(&muxConns, "mux", 0, "share this many connections per remote between all clients (0 to disable)")
+	flag.BoolVar(&coalesce, "coalesce", false, "send a single request for the concurrent gets of a key")
+	flag.DurationVar(&DefaultTimeouts.Connect, "connecttimeout", 0, "remote connect timeout (default 100ms)")
+	flag.DurationVar(&DefaultTimeouts.Read, "readtimeout", 0, "remote read timeout (default 100ms)")
+	flag.DurationVar(&DefaultTimeouts.Write, "writetimeout", 0, "remote write timeout (default 100ms)")
+	flag.Var(commandTimeouts(DefaultTimeouts.Commands), "cmdtimeout", "remote read timeout of a command, as name=duration")
+	flag.DurationVar(&clientIdle, "clientidle", 0, "close client connections idle for this long (0 to keep)")
+	flag.DurationVar(&clientRead, "clientread", 0, "client request read timeout (0 for none)")
+	flag.DurationVar(&clientWrite, "clientwrite", 0, "client response write timeout (0 for none)")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", 30*time.Second, "time to drain connections on SIGTERM")
+	flag.IntVar(&DefaultPoolOptions.MaxIdle, "maxidle", DefaultPoolOptions.MaxIdle, "maximum idle connections per remote")
+	flag.IntVar(&DefaultPoolOptions.MaxActive, "maxactive", DefaultPoolOptions.MaxActive, "maximum open connections per remote (0 for no limit)")
+	flag.DurationVar(&DefaultPoolOptions.WaitTimeout, "poolwait", DefaultPoolOptions.WaitTimeout, "time to wait for a connection when maxactive is reached")
+	flag.DurationVar(&DefaultPoolOptions.IdleTimeout, "idletimeout", DefaultPoolOptions.IdleTimeout, "close remote connections idle for this long (0 to keep)")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "write cpu profile to this file")
 	flag.StringVar(&memprofile, "memprofile", "", "write mem profile to this file")
 }
@@ -45,7 +173,7 @@ type Handler interface {
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
-	applog.SetLevel(verbose)
+	setVerbose(verbose)
 
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
@@ -71,22 +199,195 @@ func main() {
 		}()
 	}
 
+	var cfg *Config
+	var err error
+	if configFile != "" {
+		if cfg, err = LoadConfig(configFile); err != nil {
+			applog.Criticalf("Failed to load config: %s", err)
+			return
+		}
+	} else if cfg, err = flagConfig(); err != nil {
+		applog.Criticalf("Invalid flags: %s", err)
+		return
+	}
+	p, err := NewProxy(cfg)
+	if err != nil {
+		applog.Criticalf("%s", err)
+		return
+	}
+	if err = p.Listen(); err != nil {
+		applog.Criticalf("%s", err)
+		p.Close()
+		return
+	}
+	reload := func() error {
+		if configFile == "" {
+			return fmt.Errorf("Nothing to reload without -config")
+		}
+		cfg, err := LoadConfig(configFile)
+		if err == nil {
+			err = p.Reload(cfg)
+		}
+		if err != nil {
+			applog.Errorf("Failed to reload config: %s", err)
+		}
+		return err
+	}
+	if configFile != "" && watchInterval > 0 {
+		go watchConfig(configFile, watchInterval, reload)
+	}
+	if adminAddr != "" {
+		cfg.Admin = adminAddr
+	}
+	if cfg.Admin != "" {
+		if err = p.ListenAdmin(cfg.Admin, reload); err != nil {
+			applog.Criticalf("%s", err)
+			p.Close()
+			return
+		}
+	}
+	closeInherited()
+	if err = notifyParent(); err != nil {
+		applog.Errorf("Failed to notify parent process: %s", err)
+	}
+
+	c := make(chan os.Signal, 1)
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+	if upgradeSignal != nil {
+		signals = append(signals, upgradeSignal)
+	}
+	signal.Notify(c, signals...)
+	for sig := range c {
+		applog.Infof("Got signal: %s", sig)
+		switch sig {
+		case syscall.SIGHUP:
+			reload()
+			continue
+		case upgradeSignal:
+			child, err := p.Upgrade()
+			if err != nil {
+				applog.Errorf("Failed to upgrade: %s", err)
+			} else {
+				applog.Infof("Started new process %d", child.Pid)
+			}
+			continue
+		case syscall.SIGTERM:
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := p.Shutdown(ctx); err != nil {
+				applog.Warningf("Failed to drain connections: %s", err)
+			}
+			p.Close()
+		}
+		return
+	}
+}
+
+// flagConfig describes the single listener and the pools given on the
+// command line.
+func flagConfig() (*Config, error) {
 	applog.Infof("local: %q", local)
 	applog.Infof("remotes: %q", remotes)
+	applog.Infof("fallbacks: %q", fallbacks)
+
+	pool := &PoolConfig{
+		Servers:    remotes,
+		Mux:        muxConns,
+		Coalesce:   coalesce,
+		Ack:        ackMode,
+		ShadowRate: shadowRate,
+		ShadowLog:  shadowLog,
+		MigrateTTL: migrateTTL,
 
-	ss := new(ServerList)
-	ss.SetServers(remotes)
-	handler := NewMemcacheHandler(ss)
-	s := Server{
-		Addr:    local,
-		Handler: handler,
+		HotKeys:       hotKeys,
+		HotKeysWindow: Duration(hotKeysWindow),
 	}
-	go s.ListenAndServe()
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	for {
-		s := <-c
-		applog.Infof("Got signal: %s", s)
-		return
+	cfg := &Config{
+		Listeners: []*ListenerConfig{{Addr: local, Pool: "default"}},
+		Pools:     map[string]*PoolConfig{"default": pool},
+	}
+	if accessLogFile != "" {
+		cfg.AccessLog = &AccessLogConfig{
+			Rate: accessLogRate,
+			Key:  accessLogKey,
+		}
+		if accessLogFile != "-" {
+			cfg.AccessLog.File = accessLogFile
+		}
+	}
+	if socketMode != "" || socketOwner != "" || socketGroup != "" {
+		cfg.Listeners[0].Socket = &UnixSocketConfig{
+			Mode:  socketMode,
+			Owner: socketOwner,
+			Group: socketGroup,
+		}
+	}
+	if remoteTLS {
+		pool.TLS = &ClientTLSConfig{
+			CAFile:   remoteTLSCA,
+			CertFile: remoteTLSCert,
+			KeyFile:  remoteTLSKey,
+		}
+	}
+	if tlsCert != "" {
+		cfg.Listeners[0].TLS = &ServerTLSConfig{
+			CertFile:          tlsCert,
+			KeyFile:           tlsKey,
+			ClientCAFile:      tlsClientCA,
+			RequireClientCert: tlsClientCA != "",
+		}
+	}
+	if maxConns > 0 || maxConnsPerIP > 0 {
+		cfg.ConnLimits = &ConnLimitsConfig{
+			MaxConns:      maxConns,
+			MaxConnsPerIP: maxConnsPerIP,
+			Mode:          maxConnsMode,
+		}
+	}
+	if slowLog > 0 {
+		cfg.SlowLog = &SlowLogConfig{
+			Threshold: Duration(slowLog),
+			File:      slowLogFile,
+			HashKeys:  slowLogHash,
+		}
+	}
+	if hotCacheTTL > 0 {
+		pool.HotCache = &HotCacheConfig{
+			TTL:         Duration(hotCacheTTL),
+			MaxBytes:    hotCacheSize,
+			MinRequests: hotCacheMin,
+		}
+	}
+	if negCacheTTL > 0 {
+		pool.NegativeCache = &NegativeCacheConfig{
+			TTL:      Duration(negCacheTTL),
+			MaxBytes: negCacheSize,
+		}
+	}
+	if ipRate > 0 || userRate > 0 {
+		pool.RateLimits = new(RateLimitsConfig)
+		if ipRate > 0 {
+			pool.RateLimits.PerIP = &RateConfig{Rate: ipRate}
+		}
+		if userRate > 0 {
+			pool.RateLimits.PerUser = &RateConfig{Rate: userRate}
+		}
+	}
+	if len(fallbacks) > 0 {
+		cfg.Pools["fallback"] = &PoolConfig{Servers: fallbacks}
+		pool.Fallback = []string{"fallback"}
+	}
+	for _, r := range replicas {
+		cfg.Pools[r] = &PoolConfig{Servers: strings.Split(r, ",")}
+		pool.Replicas = append(pool.Replicas, r)
+	}
+	if migrate != "" {
+		cfg.Pools["migrate"] = &PoolConfig{Servers: strings.Split(migrate, ",")}
+		pool.MigrateFrom = "migrate"
+	}
+	if shadow != "" {
+		cfg.Pools["shadow"] = &PoolConfig{Servers: strings.Split(shadow, ",")}
+		pool.Shadow = "shadow"
 	}
+	return cfg, cfg.Validate()
 }
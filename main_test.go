@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"runtime"
 	"testing"
+	"time"
 
 	"git.jumbo.ws/go/tcgl/applog"
 	"github.com/bmizerany/mc"
@@ -156,13 +160,44 @@ func BenchmarkDelete(b *testing.B) {
 	}
 }
 
+func TestGetFallback(t *testing.T) {
+	// Nothing listens on the primary, every read must use the fallback.
+	ss := new(ServerList)
+	ss.SetServers([]string{"127.0.0.1:1"})
+	handler := NewMemcacheHandler(ss)
+	fs := new(ServerList)
+	fs.SetServers([]string{server})
+	handler.SetFallback(NewFromSelector(fs))
+
+	addr := serveProxy(t, handler)
+	sc := newConn(t, server)
+	pc := newConn(t, addr)
+
+	err := sc.Set("foo", "bar", 0, 0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	val, _, _, err := pc.Get("foo")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if val != "bar" {
+		t.Errorf("result not match: %s", val)
+	}
+}
+
 func newProxy(tb TB) string {
 	if proxy != "" {
 		return proxy
 	}
 	ss := new(ServerList)
 	ss.SetServers([]string{server})
-	handler := NewMemcacheHandler(ss)
+	return serveProxy(tb, NewMemcacheHandler(ss))
+}
+
+func serveProxy(tb TB, handler Handler) string {
 	s := Server{
 		Addr:    ":0",
 		Handler: handler,
@@ -184,3 +219,233 @@ func newConn(tb TB, addr string) *mc.Conn {
 	}
 	return conn
 }
+
+func TestMux(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	ss := new(ServerList)
+	ss.SetServers([]string{f.Addr()})
+	handler := NewMemcacheHandler(ss)
+	handler.SetMux(2)
+	addr := serveProxy(t, handler)
+
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			defer func() { done <- true }()
+			pc := newConn(t, addr)
+			if pc == nil {
+				return
+			}
+			key := fmt.Sprintf("foo%d", i)
+			for j := 0; j < 50; j++ {
+				val := fmt.Sprintf("bar%d", j)
+				if err := pc.Set(key, val, 0, 0, 0); err != nil {
+					t.Error(err)
+					return
+				}
+				got, _, _, err := pc.Get(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got != val {
+					t.Errorf("result not match: %s", got)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+
+	if n := f.Conns(); n > 2 {
+		t.Errorf("got %d server connections, want at most 2", n)
+	}
+}
+
+func TestMuxSlot(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	ss := new(ServerList)
+	ss.SetServers([]string{f.Addr()})
+	handler := NewMemcacheHandler(ss)
+	handler.SetMux(4)
+	pc := newConn(t, serveProxy(t, handler))
+	// The requests of a client connection are all sent on the same server
+	// connection, so that they are answered in order.
+	for i := 0; i < 8; i++ {
+		val := fmt.Sprintf("bar%d", i)
+		if err := pc.Set("foo", val, 0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, _, _, err := pc.Get("foo"); err != nil || got != val {
+			t.Fatalf("got %q, %v, want %s", got, err, val)
+		}
+	}
+	if n := f.Conns(); n != 1 {
+		t.Errorf("got %d server connections, want 1", n)
+	}
+}
+
+func TestRandomServerSticky(t *testing.T) {
+	f1, f2 := newFakeMemcached(t), newFakeMemcached(t)
+	defer f1.Close()
+	defer f2.Close()
+
+	for _, mux := range []int{0, 2} {
+		ss := new(ServerList)
+		ss.SetServers([]string{f1.Addr(), f2.Addr()})
+		handler := NewMemcacheHandler(ss)
+		if mux > 0 {
+			handler.SetMux(mux)
+		}
+		pc := newConn(t, serveProxy(t, handler))
+		for i := 0; i < 50; i++ {
+			key, val := fmt.Sprintf("sticky%d", i), fmt.Sprintf("bar%d", mux)
+			if err := pc.Set(key, val, 0, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got, _, _, err := pc.Get(key); err != nil || got != val {
+				t.Fatalf("mux %d: got %q, %v, want %s", mux, got, err, val)
+			}
+		}
+	}
+}
+
+func TestMuxRetire(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	client := newPoolClient(t, f.Addr(), DefaultPoolOptions)
+	m := NewMux(client, 1)
+	addr, err := client.pickServer("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := m.pick(addr, m.slot())
+	req := newStorageRequest(SET, []byte("foo"), []byte("bar"), 0, 0)
+	if err = mc.send(req, &call{opcode: SET}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Calls that picked the connection before its server was removed fail
+	// instead of queueing on it.
+	m.retire([]net.Addr{mc.addr})
+	if err = mc.send(req, &call{opcode: SET}); err != ErrServerRemoved {
+		t.Errorf("got %v, want %v", err, ErrServerRemoved)
+	}
+	mc = &muxConn{client: client, addr: mc.addr, pending: make(chan *call, 1)}
+	mc.shutdown()
+	if err = mc.send(req, &call{opcode: SET}); err != errMuxClosed {
+		t.Errorf("got %v, want %v", err, errMuxClosed)
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	ss := new(ServerList)
+	ss.SetServers([]string{f.Addr()})
+	s := Server{
+		Addr:        "127.0.0.1:0",
+		Handler:     NewMemcacheHandler(ss),
+		IdleTimeout: 50 * time.Millisecond,
+	}
+	l, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	var b [1]byte
+	if _, err = c.Read(b[:]); err != io.EOF {
+		t.Errorf("got %v, want EOF from an idle connection", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	ss := new(ServerList)
+	ss.SetServers([]string{f.Addr()})
+	handler := NewMemcacheHandler(ss)
+	s := Server{
+		Addr:    "127.0.0.1:0",
+		Handler: handler,
+	}
+	l, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.serve(l) }()
+
+	pc := newConn(t, l.Addr().String())
+	if err = pc.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shutdown: %s", err)
+	}
+	handler.Close()
+
+	if err = <-served; err != ErrServerClosed {
+		t.Errorf("got %v, want ErrServerClosed", err)
+	}
+	if _, _, _, err = pc.Get("foo"); err == nil {
+		t.Error("idle connection was not closed")
+	}
+	if _, err = net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("listener was not closed")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	ss := new(ServerList)
+	ss.SetServers([]string{f.Addr()})
+	s := Server{
+		Addr:    "127.0.0.1:0",
+		Handler: NewMemcacheHandler(ss),
+		Auth:    &Auth{Users: map[string]string{"user": "secret"}},
+	}
+	l, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(l)
+
+	pc := newConn(t, l.Addr().String())
+	if err = pc.Set("foo", "bar", 0, 0, 0); err == nil {
+		t.Error("unauthenticated set succeeded")
+	}
+	if err = pc.Auth("user", "wrong"); err == nil {
+		t.Error("authenticated with a wrong password")
+	}
+	if err = pc.Auth("user", "secret"); err != nil {
+		t.Fatalf("Failed to authenticate: %s", err)
+	}
+	if err = pc.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Error(err)
+	}
+}
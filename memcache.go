@@ -2,31 +2,70 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
-	ErrCacheMiss    = errors.New("memcache: cache miss")
-	ErrCASConflict  = errors.New("memcache: compare-and-swap conflit")
-	ErrNotStored    = errors.New("memcache: item not stored")
-	ErrServerError  = errors.New("memcache: server error")
-	ErrNoStats      = errors.New("memcache: no statistics available")
-	ErrMalformedKey = errors.New("malformed: key is too long or contains invalid characters")
-	ErrNoServers    = errors.New("memcache: no servers configured or available")
+	ErrCacheMiss     = errors.New("memcache: cache miss")
+	ErrCASConflict   = errors.New("memcache: compare-and-swap conflit")
+	ErrNotStored     = errors.New("memcache: item not stored")
+	ErrServerError   = errors.New("memcache: server error")
+	ErrNoStats       = errors.New("memcache: no statistics available")
+	ErrMalformedKey  = errors.New("malformed: key is too long or contains invalid characters")
+	ErrNoServers     = errors.New("memcache: no servers configured or available")
+	ErrPoolTimeout   = errors.New("memcache: timed out waiting for a connection")
+	ErrClientClosed  = errors.New("memcache: client is closed")
+	ErrServerRemoved = errors.New("memcache: server was removed")
 )
 
 const DefaultTimeout = time.Duration(100) * time.Millisecond
 
-const (
-	buffered            = 8 // arbitrary buffered channel size, for readability
-	maxIdleConnsPerAddr = 2 // TODO(bradfitz): make this configurable?
-)
+const buffered = 8 // arbitrary buffered channel size, for readability
+
+// PoolOptions limits the connections a Client keeps to each server.
+type PoolOptions struct {
+	// Maximum number of idle connections per server.
+	MaxIdle int
+	// Maximum number of open connections per server, idle or in use.
+	// Zero means no limit.
+	MaxActive int
+	// How long to wait for a connection when MaxActive is reached.
+	// Zero means the client's network timeout.
+	WaitTimeout time.Duration
+	// Idle connections are closed after this long. Zero means never.
+	IdleTimeout time.Duration
+}
+
+// Timeouts of a Client's network operations. Zero values fall back to
+// Client.Timeout.
+type Timeouts struct {
+	Connect time.Duration
+	Read    time.Duration
+	Write   time.Duration
+	// Read timeouts of individual commands, overriding Read.
+	Commands map[CommandCode]time.Duration
+}
+
+// DefaultTimeouts is used by new clients.
+var DefaultTimeouts = Timeouts{
+	Commands: make(map[CommandCode]time.Duration),
+}
+
+// DefaultPoolOptions is used by clients created with NewFromSelector.
+var DefaultPoolOptions = PoolOptions{
+	MaxIdle:     2,
+	IdleTimeout: time.Minute,
+}
 
 func resumableError(err error) bool {
 	switch err {
@@ -39,6 +78,8 @@ func resumableError(err error) bool {
 type ServerSelector interface {
 	SetServers(servers []string) error
 	PickServer(key string) (net.Addr, error)
+	// Servers returns the resolved addresses of the servers.
+	Servers() []net.Addr
 }
 
 type ServerList struct {
@@ -46,23 +87,41 @@ type ServerList struct {
 	addrs []net.Addr
 }
 
-func (ss *ServerList) SetServers(servers []string) error {
+// hostAddr is the resolved address of a server that keeps the host it was
+// given as, to verify the server's TLS certificate.
+type hostAddr struct {
+	*net.TCPAddr
+	host string
+}
+
+// resolveServers resolves server addresses. Addresses containing a "/"
+// are unix sockets.
+func resolveServers(servers []string) ([]net.Addr, error) {
 	naddr := make([]net.Addr, len(servers))
 	for i, server := range servers {
 		if strings.Contains(server, "/") {
 			addr, err := net.ResolveUnixAddr("unix", server)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			naddr[i] = addr
 		} else {
 			addr, err := net.ResolveTCPAddr("tcp", server)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			naddr[i] = addr
+			host, _, _ := net.SplitHostPort(server)
+			naddr[i] = &hostAddr{addr, host}
 		}
 	}
+	return naddr, nil
+}
+
+func (ss *ServerList) SetServers(servers []string) error {
+	naddr, err := resolveServers(servers)
+	if err != nil {
+		return err
+	}
 
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
@@ -80,37 +139,107 @@ func (ss *ServerList) PickServer(key string) (net.Addr, error) {
 	return ss.addrs[rand.Intn(len(ss.addrs))], nil
 }
 
+func (ss *ServerList) Servers() []net.Addr {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.addrs
+}
+
 type Client struct {
 	Timeout  time.Duration
+	Timeouts Timeouts
+	Pool     PoolOptions
+	// Connects to the servers over TLS if set. The server name defaults
+	// to the host each server was given as.
+	TLSConfig *tls.Config
+
 	selector ServerSelector
 	mu       sync.Mutex
 	freeconn map[string][]*conn
+	// Open connections per server, idle or in use.
+	active map[string]int
+	// Closed when a connection to the server is released.
+	released map[string]chan struct{}
+	// Servers removed from the selector, and servers drained until told
+	// otherwise. Their connections are closed instead of pooled.
+	retired map[string]bool
+	drained map[string]bool
+	// Connect failures per server.
+	health map[string]*serverHealth
+	reaper sync.Once
+	closed bool
+	quit   chan struct{}
 }
 
 func NewFromSelector(ss ServerSelector) *Client {
-	return &Client{selector: ss}
+	return NewClient(ss, DefaultPoolOptions)
+}
+
+func NewClient(ss ServerSelector, opts PoolOptions) *Client {
+	return &Client{
+		selector: ss,
+		Timeouts: DefaultTimeouts,
+		Pool:     opts,
+		freeconn: make(map[string][]*conn),
+		active:   make(map[string]int),
+		released: make(map[string]chan struct{}),
+		retired:  make(map[string]bool),
+		drained:  make(map[string]bool),
+		health:   make(map[string]*serverHealth),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Close closes the idle connections. Connections in use are closed when
+// they are released, and no new ones are opened.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.quit)
+	for key, freelist := range c.freeconn {
+		for _, cn := range freelist {
+			c.closeLocked(cn)
+		}
+		delete(c.freeconn, key)
+	}
+	return nil
+}
+
+// signalLocked wakes up the callers waiting for a connection to key.
+func (c *Client) signalLocked(key string) {
+	if ch, ok := c.released[key]; ok {
+		close(ch)
+		delete(c.released, key)
+	}
 }
 
 func (c *Client) putFreeConn(addr net.Addr, cn *conn) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.freeconn == nil {
-		c.freeconn = make(map[string][]*conn)
+	if cn.closed {
+		return
 	}
-	freelist := c.freeconn[addr.String()]
-	if len(freelist) >= maxIdleConnsPerAddr {
-		cn.nc.Close()
+	key := addr.String()
+	freelist := c.freeconn[key]
+	if c.closed || c.retired[key] || c.drained[key] || len(freelist) >= c.Pool.MaxIdle {
+		c.closeLocked(cn)
 		return
 	}
-	c.freeconn[addr.String()] = append(freelist, cn)
+	cn.idleSince = time.Now()
+	c.freeconn[key] = append(freelist, cn)
+	c.signalLocked(key)
+	if c.Pool.IdleTimeout > 0 {
+		c.reaper.Do(func() { go c.reap() })
+	}
 }
 
 func (c *Client) getFreeConn(addr net.Addr) (cn *conn, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.freeconn == nil {
-		return nil, false
-	}
 	freelist, ok := c.freeconn[addr.String()]
 	if !ok || len(freelist) == 0 {
 		return nil, false
@@ -120,6 +249,100 @@ func (c *Client) getFreeConn(addr net.Addr) (cn *conn, ok bool) {
 	return cn, true
 }
 
+// closeConn closes cn and gives its slot to the callers waiting for a
+// connection. It is safe to call more than once.
+func (c *Client) closeConn(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(cn)
+}
+
+func (c *Client) closeLocked(cn *conn) {
+	if cn.closed {
+		return
+	}
+	cn.closed = true
+	cn.nc.Close()
+	key := cn.addr.String()
+	c.active[key]--
+	c.signalLocked(key)
+}
+
+// reserve claims a slot for a new connection to addr, waiting up to the
+// pool's wait timeout if MaxActive connections are open. The returned
+// channel is non-nil if the caller has to wait for it and try again.
+func (c *Client) reserve(addr net.Addr) (wait chan struct{}, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := addr.String()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if len(c.freeconn[key]) > 0 {
+		// Released meanwhile, try the free list again.
+		wait = make(chan struct{})
+		close(wait)
+		return wait, nil
+	}
+	if c.Pool.MaxActive <= 0 || c.active[key] < c.Pool.MaxActive {
+		c.active[key]++
+		return nil, nil
+	}
+	wait, ok := c.released[key]
+	if !ok {
+		wait = make(chan struct{})
+		c.released[key] = wait
+	}
+	return wait, nil
+}
+
+func (c *Client) unreserve(addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := addr.String()
+	c.active[key]--
+	c.signalLocked(key)
+}
+
+func (c *Client) waitTimeout() time.Duration {
+	if c.Pool.WaitTimeout != 0 {
+		return c.Pool.WaitTimeout
+	}
+	return c.netTimeout()
+}
+
+// reap closes the connections that have been idle for longer than the
+// idle timeout.
+func (c *Client) reap() {
+	interval := c.Pool.IdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.quit:
+			return
+		}
+		expire := time.Now().Add(-c.Pool.IdleTimeout)
+		c.mu.Lock()
+		for key, freelist := range c.freeconn {
+			// The free list is in release order, oldest first.
+			n := 0
+			for n < len(freelist) && freelist[n].idleSince.Before(expire) {
+				c.closeLocked(freelist[n])
+				n++
+			}
+			if n > 0 {
+				c.freeconn[key] = append(freelist[:0], freelist[n:]...)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
 func (c *Client) netTimeout() time.Duration {
 	if c.Timeout != 0 {
 		return c.Timeout
@@ -127,8 +350,200 @@ func (c *Client) netTimeout() time.Duration {
 	return DefaultTimeout
 }
 
+func (c *Client) connectTimeout() time.Duration {
+	if c.Timeouts.Connect != 0 {
+		return c.Timeouts.Connect
+	}
+	return c.netTimeout()
+}
+
+// readTimeout returns how long to wait for the response to opcode.
+func (c *Client) readTimeout(opcode CommandCode) time.Duration {
+	if d, ok := c.Timeouts.Commands[opcode]; ok {
+		return d
+	}
+	if c.Timeouts.Read != 0 {
+		return c.Timeouts.Read
+	}
+	return c.netTimeout()
+}
+
+func (c *Client) writeTimeout() time.Duration {
+	if c.Timeouts.Write != 0 {
+		return c.Timeouts.Write
+	}
+	return c.netTimeout()
+}
+
+// SetSelector replaces the selector picking the servers of keys. The idle
+// connections to the removed servers are closed, and the ones in use are
+// closed when released, until they are added back.
+func (c *Client) SetSelector(ss ServerSelector, removed []net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.selector = ss
+	for _, addr := range ss.Servers() {
+		delete(c.retired, addr.String())
+	}
+	for _, addr := range removed {
+		c.retireLocked(addr.String())
+	}
+}
+
+// Drain closes the idle connections to addr and the ones in use when they
+// are released, until Undrain is called. New connections are opened as
+// needed, but not pooled.
+func (c *Client) Drain(addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drained[addr.String()] = true
+	c.closeIdleLocked(addr.String())
+}
+
+// Undrain pools the connections to addr again.
+func (c *Client) Undrain(addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.drained, addr.String())
+}
+
+func (c *Client) retireLocked(key string) {
+	c.retired[key] = true
+	c.closeIdleLocked(key)
+}
+
+func (c *Client) closeIdleLocked(key string) {
+	for _, cn := range c.freeconn[key] {
+		c.closeLocked(cn)
+	}
+	delete(c.freeconn, key)
+}
+
+// serverHealth counts the failures to connect to a server, and the bytes
+// exchanged with it.
+type serverHealth struct {
+	// Updated atomically by the connections to the server.
+	readBytes    uint64
+	writtenBytes uint64
+
+	failures   int
+	lastErr    error
+	lastFail   time.Time
+	dialErrors uint64
+	timeouts   uint64
+}
+
+// ServerStats are the connections a Client holds to a server and how
+// connecting to it went.
+type ServerStats struct {
+	Idle   int
+	Active int
+	// Connections are closed when released if the server was removed
+	// or drained.
+	Retired bool
+	Drained bool
+	// Connect failures since the last successful connect.
+	Failures  int
+	LastError error
+	LastFail  time.Time
+	// Totals since the client was created.
+	DialErrors   uint64
+	Timeouts     uint64
+	ReadBytes    uint64
+	WrittenBytes uint64
+}
+
+// Stats returns the connections and health of addr.
+func (c *Client) Stats(addr net.Addr) ServerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := addr.String()
+	st := ServerStats{
+		Idle:    len(c.freeconn[key]),
+		Active:  c.active[key],
+		Retired: c.retired[key],
+		Drained: c.drained[key],
+	}
+	if h, ok := c.health[key]; ok {
+		st.Failures, st.LastError, st.LastFail = h.failures, h.lastErr, h.lastFail
+		st.DialErrors, st.Timeouts = h.dialErrors, h.timeouts
+		st.ReadBytes = atomic.LoadUint64(&h.readBytes)
+		st.WrittenBytes = atomic.LoadUint64(&h.writtenBytes)
+	}
+	return st
+}
+
+func (c *Client) healthLocked(addr net.Addr) *serverHealth {
+	key := addr.String()
+	h, ok := c.health[key]
+	if !ok {
+		h = new(serverHealth)
+		c.health[key] = h
+	}
+	return h
+}
+
+func (c *Client) recordDial(addr net.Addr, err error) *serverHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.healthLocked(addr)
+	if err == nil {
+		h.failures = 0
+		return h
+	}
+	h.failures++
+	h.dialErrors++
+	h.lastErr = err
+	h.lastFail = time.Now()
+	return h
+}
+
+// checkTimeout counts err against addr if it is a timeout.
+func (c *Client) checkTimeout(addr net.Addr, err error) {
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.healthLocked(addr).timeouts++
+}
+
+func (c *Client) pickServer(key string) (net.Addr, error) {
+	c.mu.Lock()
+	ss := c.selector
+	c.mu.Unlock()
+	return ss.PickServer(key)
+}
+
+// Servers returns the addresses of the servers of the selector.
+func (c *Client) Servers() []net.Addr {
+	c.mu.Lock()
+	ss := c.selector
+	c.mu.Unlock()
+	return ss.Servers()
+}
+
+// hasServer tells whether addr is one of the servers of the selector.
+func (c *Client) hasServer(addr net.Addr) bool {
+	for _, a := range c.Servers() {
+		if a.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// randomServers tells whether the servers are picked at random rather
+// than by key.
+func (c *Client) randomServers() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.selector.(*ServerList)
+	return ok
+}
+
 func (c *Client) PickConn(key string) (*conn, error) {
-	addr, err := c.selector.PickServer(key)
+	addr, err := c.pickServer(key)
 	if err != nil {
 		return nil, err
 	}
@@ -139,6 +554,36 @@ func (c *Client) PickConn(key string) (*conn, error) {
 	return cn, nil
 }
 
+// roundTrip sends req to the server picked for its key and reads the
+// reply into rsp. The connection is returned to the pool afterwards.
+func (c *Client) roundTrip(req *request, rsp *response) error {
+	addr, err := c.pickServer(string(req.key))
+	if err != nil {
+		return err
+	}
+	return c.roundTripTo(addr, req, rsp)
+}
+
+// roundTripTo sends req to addr and reads the response into rsp.
+func (c *Client) roundTripTo(addr net.Addr, req *request, rsp *response) (err error) {
+	cn, err := c.getConn(addr)
+	if err != nil {
+		return
+	}
+	defer cn.condRelease(&err)
+
+	rw := wrapVerbose(cn)
+	if err = req.WriteTo(rw); err != nil {
+		return
+	}
+	if err = rw.Flush(); err != nil {
+		return
+	}
+	cn.expect(req.opcode)
+	rsp.init(req.opcode)
+	return rsp.ReadFrom(rw)
+}
+
 // ConnectTimeoutError is the error type used when it takes
 // too long to connect to the desired host. This level of
 // detail can generally be ignored.
@@ -158,12 +603,15 @@ func (c *Client) dial(addr net.Addr) (net.Conn, error) {
 	ch := make(chan connError)
 	go func() {
 		nc, err := net.Dial(addr.Network(), addr.String())
+		if err == nil && c.TLSConfig != nil {
+			nc, err = c.handshake(nc, addr)
+		}
 		ch <- connError{nc, err}
 	}()
 	select {
 	case ce := <-ch:
 		return ce.cn, ce.err
-	case <-time.After(c.netTimeout()):
+	case <-time.After(c.connectTimeout()):
 		// Too slow. Fall through.
 	}
 	// Close the conn if it does end up finally coming in
@@ -176,46 +624,107 @@ func (c *Client) dial(addr net.Addr) (net.Conn, error) {
 	return nil, &ConnectTimeoutError{addr}
 }
 
+// handshake starts TLS on nc, within the connect timeout.
+func (c *Client) handshake(nc net.Conn, addr net.Addr) (net.Conn, error) {
+	conf := c.TLSConfig
+	if ha, ok := addr.(*hostAddr); ok && conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName = ha.host
+	}
+	tc := tls.Client(nc, conf)
+	tc.SetDeadline(time.Now().Add(c.connectTimeout()))
+	if err := tc.Handshake(); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %s", addr, err)
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
 func (c *Client) getConn(addr net.Addr) (*conn, error) {
-	cn, ok := c.getFreeConn(addr)
-	if ok {
-		cn.extendDeadline()
-		return cn, nil
+	deadline := time.Now().Add(c.waitTimeout())
+	for {
+		for {
+			cn, ok := c.getFreeConn(addr)
+			if !ok {
+				break
+			}
+			if cn.alive() {
+				cn.expect(UNKNOWN)
+				cn.extendDeadline()
+				return cn, nil
+			}
+			c.closeConn(cn)
+		}
+		wait, err := c.reserve(addr)
+		if err != nil {
+			return nil, err
+		}
+		if wait == nil {
+			break
+		}
+		select {
+		case <-wait:
+		case <-time.After(deadline.Sub(time.Now())):
+			return nil, ErrPoolTimeout
+		}
 	}
+
 	nc, err := c.dial(addr)
+	health := c.recordDial(addr, err)
 	if err != nil {
+		c.unreserve(addr)
 		return nil, err
 	}
-	cn = &conn{
-		nc:   nc,
-		addr: addr,
-		rw:   bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
-		c:    c,
+	cn := &conn{
+		nc:     nc,
+		addr:   addr,
+		rw:     bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+		c:      c,
+		health: health,
 	}
+	cn.expect(UNKNOWN)
 	cn.extendDeadline()
 	return cn, nil
 }
 
 type conn struct {
-	nc   net.Conn
-	rw   *bufio.ReadWriter
-	addr net.Addr
-	c    *Client
+	nc     net.Conn
+	rw     *bufio.ReadWriter
+	addr   net.Addr
+	c      *Client
+	health *serverHealth
+
+	// Deadline of each read, depending on the expected response.
+	readTimeout time.Duration
+
+	// Guarded by c.mu
+	idleSince time.Time
+	closed    bool
 }
 
 func (c *conn) Read(p []byte) (n int, err error) {
-	c.extendDeadline()
-	return c.rw.Reader.Read(p)
+	c.extendReadDeadline()
+	n, err = c.rw.Reader.Read(p)
+	atomic.AddUint64(&c.health.readBytes, uint64(n))
+	c.c.checkTimeout(c.addr, err)
+	return
 }
 
 func (c *conn) ReadSlice(delim byte) (line []byte, err error) {
-	c.extendDeadline()
-	return c.rw.Reader.ReadSlice(delim)
+	c.extendReadDeadline()
+	line, err = c.rw.Reader.ReadSlice(delim)
+	atomic.AddUint64(&c.health.readBytes, uint64(len(line)))
+	c.c.checkTimeout(c.addr, err)
+	return
 }
 
 func (c *conn) Write(p []byte) (n int, err error) {
-	c.extendDeadline()
-	return c.rw.Writer.Write(p)
+	c.extendWriteDeadline()
+	n, err = c.rw.Writer.Write(p)
+	atomic.AddUint64(&c.health.writtenBytes, uint64(n))
+	c.c.checkTimeout(c.addr, err)
+	return
 }
 
 func (c *conn) WriteTo(w io.Writer) (int64, error) {
@@ -224,12 +733,15 @@ func (c *conn) WriteTo(w io.Writer) (int64, error) {
 }
 
 func (c *conn) Close() error {
-	return c.nc.Close()
+	c.c.closeConn(c)
+	return nil
 }
 
-func (c *conn) Flush() error {
-	c.extendDeadline()
-	return c.rw.Flush()
+func (c *conn) Flush() (err error) {
+	c.extendWriteDeadline()
+	err = c.rw.Flush()
+	c.c.checkTimeout(c.addr, err)
+	return
 }
 
 // release returns this connection back to the client's free pool
@@ -237,8 +749,37 @@ func (cn *conn) release() {
 	cn.c.putFreeConn(cn.addr, cn)
 }
 
+// alive tells whether an idle connection can be reused. A connection that
+// has been closed by the server or has unexpected data pending is not.
+func (cn *conn) alive() bool {
+	if cn.rw.Reader.Buffered() > 0 {
+		return false
+	}
+	// TLS connections are not checked: records such as session tickets
+	// may be waiting on their socket.
+	sc, ok := cn.nc.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	return socketIdle(sc)
+}
+
+// expect sets the read timeout for the response to opcode.
+func (cn *conn) expect(opcode CommandCode) {
+	cn.readTimeout = cn.c.readTimeout(opcode)
+}
+
 func (cn *conn) extendDeadline() {
-	cn.nc.SetDeadline(time.Now().Add(cn.c.netTimeout()))
+	cn.extendReadDeadline()
+	cn.extendWriteDeadline()
+}
+
+func (cn *conn) extendReadDeadline() {
+	cn.nc.SetReadDeadline(time.Now().Add(cn.readTimeout))
+}
+
+func (cn *conn) extendWriteDeadline() {
+	cn.nc.SetWriteDeadline(time.Now().Add(cn.c.writeTimeout()))
 }
 
 // condRelease releases this connection if the error pointed to by err
@@ -249,6 +790,6 @@ func (cn *conn) condRelease(err *error) {
 	if *err == nil || resumableError(*err) {
 		cn.release()
 	} else {
-		cn.nc.Close()
+		cn.Close()
 	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// acceptAll accepts connections on l and passes them to conns.
+func acceptAll(l net.Listener, conns chan net.Conn) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conns <- c
+	}
+}
+
+func newPoolClient(t *testing.T, addr string, opts PoolOptions) *Client {
+	ss := new(ServerList)
+	if err := ss.SetServers([]string{addr}); err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(ss, opts)
+}
+
+func TestPoolMaxActive(t *testing.T) {
+	l := newListener(t)
+	defer l.Close()
+	go acceptAll(l, make(chan net.Conn, 8))
+
+	c := newPoolClient(t, l.Addr().String(), PoolOptions{
+		MaxIdle:     1,
+		MaxActive:   1,
+		WaitTimeout: 50 * time.Millisecond,
+	})
+	c.Timeout = time.Second
+
+	cn, err := c.PickConn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.PickConn(""); err != ErrPoolTimeout {
+		t.Fatalf("got %v, want ErrPoolTimeout", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cn.release()
+	}()
+	cn2, err := c.PickConn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn2 != cn {
+		t.Error("released connection was not reused")
+	}
+}
+
+func TestPoolDeadConn(t *testing.T) {
+	l := newListener(t)
+	defer l.Close()
+	conns := make(chan net.Conn, 8)
+	go acceptAll(l, conns)
+
+	c := newPoolClient(t, l.Addr().String(), PoolOptions{MaxIdle: 1})
+	c.Timeout = time.Second
+
+	cn, err := c.PickConn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.release()
+
+	// The server closes the idle connection.
+	(<-conns).Close()
+	time.Sleep(10 * time.Millisecond)
+
+	cn2, err := c.PickConn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn2 == cn {
+		t.Error("closed connection was reused")
+	}
+	if n := c.active[cn.addr.String()]; n != 1 {
+		t.Errorf("got %d active connections, want 1", n)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	l := newListener(t)
+	defer l.Close()
+	go acceptAll(l, make(chan net.Conn, 8))
+
+	c := newPoolClient(t, l.Addr().String(), PoolOptions{
+		MaxIdle:     1,
+		IdleTimeout: 10 * time.Millisecond,
+	})
+	c.Timeout = time.Second
+
+	cn, err := c.PickConn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.release()
+
+	// The reaper runs at least once a second.
+	time.Sleep(1500 * time.Millisecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.freeconn[cn.addr.String()]); n != 0 {
+		t.Errorf("got %d idle connections, want 0", n)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeMemcached speaks enough of the memcached text protocol to stand in
+// for a real server in tests.
+type fakeMemcached struct {
+	l     net.Listener
+	gets  int64
+	conns int64
+
+	mu    sync.Mutex
+	items map[string]fakeItem
+}
+
+type fakeItem struct {
+	flags int
+	value []byte
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	f := &fakeMemcached{
+		l:     newListener(t),
+		items: make(map[string]fakeItem),
+	}
+	go f.serve()
+	return f
+}
+
+func (f *fakeMemcached) Addr() string {
+	return f.l.Addr().String()
+}
+
+func (f *fakeMemcached) Close() {
+	f.l.Close()
+}
+
+func (f *fakeMemcached) Gets() int64 {
+	return atomic.LoadInt64(&f.gets)
+}
+
+func (f *fakeMemcached) Conns() int64 {
+	return atomic.LoadInt64(&f.conns)
+}
+
+func (f *fakeMemcached) serve() {
+	for {
+		c, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&f.conns, 1)
+		go f.serveConn(c)
+	}
+}
+
+func (f *fakeMemcached) serveConn(c net.Conn) {
+	defer c.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) < 2 {
+			rw.WriteString("ERROR\r\n")
+			rw.Flush()
+			continue
+		}
+		f.mu.Lock()
+		switch args[0] {
+		case "get":
+			atomic.AddInt64(&f.gets, 1)
+			if it, ok := f.items[args[1]]; ok {
+				fmt.Fprintf(rw, "VALUE %s %d %d\r\n%s\r\n", args[1], it.flags, len(it.value), it.value)
+			}
+			rw.WriteString("END\r\n")
+		case "set", "add":
+			var it fakeItem
+			var exp, n int
+			fmt.Sscan(strings.Join(args[2:], " "), &it.flags, &exp, &n)
+			it.value = make([]byte, n+2)
+			if _, err := io.ReadFull(rw, it.value); err != nil {
+				f.mu.Unlock()
+				return
+			}
+			it.value = it.value[:n]
+			if _, ok := f.items[args[1]]; ok && args[0] == "add" {
+				rw.WriteString("NOT_STORED\r\n")
+			} else {
+				f.items[args[1]] = it
+				rw.WriteString("STORED\r\n")
+			}
+		case "delete":
+			if _, ok := f.items[args[1]]; ok {
+				delete(f.items, args[1])
+				rw.WriteString("DELETED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		f.mu.Unlock()
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
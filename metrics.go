@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in seconds of the latency histogram buckets.
+var latencyBuckets = []float64{
+	.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1,
+}
+
+// counterVec is a counter with labels, written in the Prometheus text
+// format.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	n      uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counterValue),
+	}
+}
+
+// with returns the counter of the label values, to be incremented with
+// atomic.AddUint64.
+func (v *counterVec) with(values ...string) *uint64 {
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	cv, ok := v.values[key]
+	if !ok {
+		cv = &counterValue{labels: values}
+		v.values[key] = cv
+	}
+	return &cv.n
+}
+
+func (v *counterVec) add(n uint64, values ...string) {
+	atomic.AddUint64(v.with(values...), n)
+}
+
+func (v *counterVec) write(w io.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range sortedKeys(v.values) {
+		cv := v.values[key]
+		writeSample(w, v.name, v.labels, cv.labels, float64(atomic.LoadUint64(&cv.n)))
+	}
+}
+
+// histogramVec is a histogram of durations with labels.
+type histogramVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+// histogramValue is updated with atomic operations, so that it can be
+// observed without holding the mutex of its vec.
+type histogramValue struct {
+	labels  []string
+	buckets []uint64
+	count   uint64
+	// math.Float64bits of the sum.
+	sum uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*histogramValue),
+	}
+}
+
+// with returns the histogram of the label values.
+func (v *histogramVec) with(values ...string) *histogramValue {
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	hv, ok := v.values[key]
+	if !ok {
+		hv = &histogramValue{
+			labels:  values,
+			buckets: make([]uint64, len(latencyBuckets)),
+		}
+		v.values[key] = hv
+	}
+	return hv
+}
+
+func (hv *histogramValue) observe(d time.Duration) {
+	s := d.Seconds()
+	for i, le := range latencyBuckets {
+		if s <= le {
+			atomic.AddUint64(&hv.buckets[i], 1)
+		}
+	}
+	for {
+		old := atomic.LoadUint64(&hv.sum)
+		if atomic.CompareAndSwapUint64(&hv.sum, old, math.Float64bits(math.Float64frombits(old)+s)) {
+			break
+		}
+	}
+	atomic.AddUint64(&hv.count, 1)
+}
+
+func (v *histogramVec) write(w io.Writer) {
+	writeHeader(w, v.name, v.help, "histogram")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	labels := append(append([]string(nil), v.labels...), "le")
+	for _, key := range sortedKeys(v.values) {
+		hv := v.values[key]
+		values := append(append([]string(nil), hv.labels...), "")
+		for i, le := range latencyBuckets {
+			values[len(values)-1] = strconv.FormatFloat(le, 'g', -1, 64)
+			writeSample(w, v.name+"_bucket", labels, values, float64(atomic.LoadUint64(&hv.buckets[i])))
+		}
+		count := float64(atomic.LoadUint64(&hv.count))
+		values[len(values)-1] = "+Inf"
+		writeSample(w, v.name+"_bucket", labels, values, count)
+		writeSample(w, v.name+"_sum", v.labels, hv.labels, math.Float64frombits(atomic.LoadUint64(&hv.sum)))
+		writeSample(w, v.name+"_count", v.labels, hv.labels, count)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*counterValue:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w io.Writer, name string, labels, values []string, v float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, label := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, labelEscaper.Replace(values[i]))
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// The metrics updated while serving requests. Gauges and backend counters
+// are read from the proxy when scraped.
+var (
+	requestsTotal = newCounterVec("mproxy_requests_total",
+		"Requests answered, by pool, command and status.", "pool", "command", "status")
+	requestDuration = newHistogramVec("mproxy_request_duration_seconds",
+		"Time from reading a request to flushing its response.", "pool", "command", "backend")
+	hitsTotal = newCounterVec("mproxy_get_hits_total",
+		"Retrievals that found the key.", "pool")
+	missesTotal = newCounterVec("mproxy_get_misses_total",
+		"Retrievals that did not find the key.", "pool")
+	hotCacheHits = newCounterVec("mproxy_hot_cache_hits_total",
+		"Retrievals answered from the hot key cache.", "pool")
+	hotCacheMisses = newCounterVec("mproxy_hot_cache_misses_total",
+		"Retrievals of hot keys that were not cached.", "pool")
+	connRejectsTotal = newCounterVec("mproxy_client_connections_rejected_total",
+		"Client connections rejected by a limit, by listener and limit: global or ip.", "listener", "limit")
+	acceptPausesTotal = newCounterVec("mproxy_accept_pauses_total",
+		"Times accepting connections stopped at the global limit.")
+	throttledTotal = newCounterVec("mproxy_throttled_total",
+		"Requests refused by a rate limit, by limit: ip, user or prefix.", "pool", "limit")
+	negativeCacheHits = newCounterVec("mproxy_negative_cache_hits_total",
+		"Retrievals answered as misses from the negative cache.", "pool")
+	coalescedTotal = newCounterVec("mproxy_coalesced_gets_total",
+		"Retrievals answered by the response to another one in flight.", "pool", "backend")
+	clientReadBytes = newCounterVec("mproxy_client_read_bytes_total",
+		"Bytes read from clients.", "pool")
+	clientWrittenBytes = newCounterVec("mproxy_client_written_bytes_total",
+		"Bytes written to clients.", "pool")
+)
+
+// requestMetrics records the requests answered on a client connection.
+// The metrics of each set of labels are looked up once per connection.
+type requestMetrics struct {
+	pool         string
+	hits, misses *uint64
+	requests     map[requestLabels]*uint64
+	durations    map[durationLabels]*histogramValue
+}
+
+type requestLabels struct {
+	opcode CommandCode
+	status Status
+}
+
+type durationLabels struct {
+	opcode  CommandCode
+	backend string
+}
+
+func newRequestMetrics(pool string) *requestMetrics {
+	return &requestMetrics{
+		pool:      pool,
+		hits:      hitsTotal.with(pool),
+		misses:    missesTotal.with(pool),
+		requests:  make(map[requestLabels]*uint64),
+		durations: make(map[durationLabels]*histogramValue),
+	}
+}
+
+// observe records the call c answered with rsp after d.
+func (m *requestMetrics) observe(c *call, rsp *response, d time.Duration) {
+	rl := requestLabels{rsp.opcode, rsp.status}
+	n, ok := m.requests[rl]
+	if !ok {
+		n = requestsTotal.with(m.pool, rsp.opcode.String(), rsp.status.String())
+		m.requests[rl] = n
+	}
+	atomic.AddUint64(n, 1)
+	dl := durationLabels{rsp.opcode, c.backend}
+	hv, ok := m.durations[dl]
+	if !ok {
+		hv = requestDuration.with(m.pool, rsp.opcode.String(), c.backend)
+		m.durations[dl] = hv
+	}
+	hv.observe(d)
+	if rsp.opcode.IsRetrieval() {
+		switch rsp.status {
+		case SUCCESS:
+			atomic.AddUint64(m.hits, 1)
+		case KEY_ENOENT:
+			atomic.AddUint64(m.misses, 1)
+		}
+	}
+}
+
+// countingReadWriter counts the bytes read and written through it.
+type countingReadWriter struct {
+	ReadWriter
+	in, out *uint64
+}
+
+func newCountingReadWriter(rw ReadWriter, pool string) *countingReadWriter {
+	return &countingReadWriter{
+		ReadWriter: rw,
+		in:         clientReadBytes.with(pool),
+		out:        clientWrittenBytes.with(pool),
+	}
+}
+
+func (rw *countingReadWriter) Read(p []byte) (n int, err error) {
+	n, err = rw.ReadWriter.Read(p)
+	atomic.AddUint64(rw.in, uint64(n))
+	return
+}
+
+func (rw *countingReadWriter) ReadSlice(delim byte) (line []byte, err error) {
+	line, err = rw.ReadWriter.ReadSlice(delim)
+	atomic.AddUint64(rw.in, uint64(len(line)))
+	return
+}
+
+func (rw *countingReadWriter) Write(p []byte) (n int, err error) {
+	n, err = rw.ReadWriter.Write(p)
+	atomic.AddUint64(rw.out, uint64(n))
+	return
+}
+
+// WriteMetrics writes the metrics of p in the Prometheus text format.
+func (p *Proxy) WriteMetrics(w io.Writer) {
+	requestsTotal.write(w)
+	requestDuration.write(w)
+	hitsTotal.write(w)
+	missesTotal.write(w)
+	hotCacheHits.write(w)
+	hotCacheMisses.write(w)
+	throttledTotal.write(w)
+	connRejectsTotal.write(w)
+	acceptPausesTotal.write(w)
+	negativeCacheHits.write(w)
+	coalescedTotal.write(w)
+	clientReadBytes.write(w)
+	clientWrittenBytes.write(w)
+
+	if p.accessLog != nil {
+		writeHeader(w, "mproxy_access_log_dropped_total", "Access log entries dropped because the writer was behind.", "counter")
+		writeSample(w, "mproxy_access_log_dropped_total", nil, nil, float64(p.accessLog.Dropped()))
+	}
+
+	writeHeader(w, "mproxy_client_connections", "Open client connections, by listener.", "gauge")
+	for _, srv := range p.servers {
+		writeSample(w, "mproxy_client_connections", []string{"listener"}, []string{srv.Addr}, float64(srv.numConns()))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	type backend struct {
+		pool, addr string
+		st         ServerStats
+	}
+	var backends []backend
+	for _, name := range p.poolNames() {
+		// The selector has the servers of the pool in order.
+		servers, client := p.cfg.Pools[name].Servers, p.clients[name]
+		for i, addr := range client.Servers() {
+			backends = append(backends, backend{name, servers[i], client.Stats(addr)})
+		}
+	}
+	type replica struct {
+		pool, name     string
+		writes, errors uint64
+	}
+	var replicas []replica
+	for _, name := range p.poolNames() {
+		if h, ok := p.handlers[name]; ok && h.replicas != nil {
+			for _, r := range h.replicas.replicas {
+				replicas = append(replicas, replica{name, r.Name, r.Writes(), r.Errors()})
+			}
+		}
+	}
+	writeHeader(w, "mproxy_replica_writes_total", "Writes sent to a replica pool, the local one included.", "counter")
+	for _, r := range replicas {
+		writeSample(w, "mproxy_replica_writes_total", []string{"pool", "replica"}, []string{r.pool, r.name}, float64(r.writes))
+	}
+	writeHeader(w, "mproxy_replica_errors_total", "Writes a replica pool failed to answer.", "counter")
+	for _, r := range replicas {
+		writeSample(w, "mproxy_replica_errors_total", []string{"pool", "replica"}, []string{r.pool, r.name}, float64(r.errors))
+	}
+
+	type hotKeys struct {
+		pool     string
+		keys     []HotKey
+		backends map[string][]HotKey
+	}
+	var hot []hotKeys
+	for _, name := range p.poolNames() {
+		if h, ok := p.handlers[name]; ok && h.hotKeys != nil {
+			keys, backends := h.hotKeys.Top()
+			hot = append(hot, hotKeys{name, keys, backends})
+		}
+	}
+	// Keys are labeled by rank, the keys themselves are listed by
+	// /hotkeys: they need not be valid label values and change often.
+	writeHeader(w, "mproxy_hot_key_requests", "Requests for the hottest keys of a pool by rank, halved every window.", "gauge")
+	for _, h := range hot {
+		for i, k := range h.keys {
+			writeSample(w, "mproxy_hot_key_requests", []string{"pool", "rank"}, []string{h.pool, strconv.Itoa(i + 1)}, float64(k.Count))
+		}
+	}
+	writeHeader(w, "mproxy_backend_hot_key_requests", "Requests for the hottest keys of a backend by rank, halved every window.", "gauge")
+	for _, h := range hot {
+		addrs := make([]string, 0, len(h.backends))
+		for addr := range h.backends {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			for i, k := range h.backends[addr] {
+				writeSample(w, "mproxy_backend_hot_key_requests", []string{"pool", "backend", "rank"}, []string{h.pool, addr, strconv.Itoa(i + 1)}, float64(k.Count))
+			}
+		}
+	}
+
+	type cache struct {
+		pool         string
+		items, bytes int
+	}
+	var hotCaches, negativeCaches []cache
+	for _, name := range p.poolNames() {
+		h, ok := p.handlers[name]
+		if !ok {
+			continue
+		}
+		if h.cache != nil {
+			items, bytes := h.cache.Len()
+			hotCaches = append(hotCaches, cache{name, items, bytes})
+		}
+		if h.misses != nil {
+			items, bytes := h.misses.Len()
+			negativeCaches = append(negativeCaches, cache{name, items, bytes})
+		}
+	}
+	writeHeader(w, "mproxy_hot_cache_items", "Values in the hot key cache.", "gauge")
+	for _, c := range hotCaches {
+		writeSample(w, "mproxy_hot_cache_items", []string{"pool"}, []string{c.pool}, float64(c.items))
+	}
+	writeHeader(w, "mproxy_hot_cache_bytes", "Memory used by the hot key cache.", "gauge")
+	for _, c := range hotCaches {
+		writeSample(w, "mproxy_hot_cache_bytes", []string{"pool"}, []string{c.pool}, float64(c.bytes))
+	}
+	writeHeader(w, "mproxy_negative_cache_items", "Keys in the negative cache.", "gauge")
+	for _, c := range negativeCaches {
+		writeSample(w, "mproxy_negative_cache_items", []string{"pool"}, []string{c.pool}, float64(c.items))
+	}
+
+	labels := []string{"pool", "backend", "state"}
+	writeHeader(w, "mproxy_backend_connections", "Open backend connections, idle or in use.", "gauge")
+	for _, b := range backends {
+		writeSample(w, "mproxy_backend_connections", labels, []string{b.pool, b.addr, "idle"}, float64(b.st.Idle))
+		writeSample(w, "mproxy_backend_connections", labels, []string{b.pool, b.addr, "in_use"}, float64(b.st.Active-b.st.Idle))
+	}
+	labels = labels[:2]
+	writeHeader(w, "mproxy_backend_dial_errors_total", "Failed attempts to connect to a backend.", "counter")
+	for _, b := range backends {
+		writeSample(w, "mproxy_backend_dial_errors_total", labels, []string{b.pool, b.addr}, float64(b.st.DialErrors))
+	}
+	writeHeader(w, "mproxy_backend_timeouts_total", "Reads and writes to a backend that timed out.", "counter")
+	for _, b := range backends {
+		writeSample(w, "mproxy_backend_timeouts_total", labels, []string{b.pool, b.addr}, float64(b.st.Timeouts))
+	}
+	writeHeader(w, "mproxy_backend_read_bytes_total", "Bytes read from a backend.", "counter")
+	for _, b := range backends {
+		writeSample(w, "mproxy_backend_read_bytes_total", labels, []string{b.pool, b.addr}, float64(b.st.ReadBytes))
+	}
+	writeHeader(w, "mproxy_backend_written_bytes_total", "Bytes written to a backend.", "counter")
+	for _, b := range backends {
+		writeSample(w, "mproxy_backend_written_bytes_total", labels, []string{b.pool, b.addr}, float64(b.st.WrittenBytes))
+	}
+}
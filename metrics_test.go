@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "metrics"}},
+		Pools:     map[string]*PoolConfig{"metrics": {Servers: []string{f.Addr()}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pc := newConn(t, serveProxy(t, p.handlers["metrics"]))
+	if err = pc.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	pc.Get("foo")
+	pc.Get("missing")
+	// Requests are observed after their response is flushed, but before
+	// the next one is answered.
+	pc.Del("foo")
+
+	var buf bytes.Buffer
+	p.WriteMetrics(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`mproxy_requests_total{pool="metrics",command="set",status="No error"} 1`,
+		`mproxy_requests_total{pool="metrics",command="get",status="Key not found"} 1`,
+		`mproxy_get_hits_total{pool="metrics"} 1`,
+		`mproxy_get_misses_total{pool="metrics"} 1`,
+		`mproxy_request_duration_seconds_bucket{pool="metrics",command="get",backend="` + f.Addr() + `",le="+Inf"} 2`,
+		`mproxy_request_duration_seconds_count{pool="metrics",command="set",backend="` + f.Addr() + `"} 1`,
+		`# TYPE mproxy_backend_connections gauge`,
+		`mproxy_backend_dial_errors_total{pool="metrics",backend="` + f.Addr() + `"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	// Request and response sizes depend on the backend protocol.
+	for _, name := range []string{"mproxy_backend_read_bytes_total", "mproxy_backend_written_bytes_total"} {
+		sample := name + `{pool="metrics",backend="` + f.Addr() + `"} `
+		if !strings.Contains(out, sample) || strings.Contains(out, sample+"0\n") {
+			t.Errorf("missing %s or zero", name)
+		}
+	}
+	if t.Failed() {
+		t.Log(out)
+	}
+}
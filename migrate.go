@@ -0,0 +1,46 @@
+package main
+
+import (
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// Migration moves traffic from an old pool to the local pool without a
+// cold cache. Writes go to both pools, retrievals that miss the local pool
+// are read from the old pool and the value is copied to the local pool.
+type Migration struct {
+	old   *Client
+	local *Client
+	// Expiration in seconds of backfilled items. The text protocol does
+	// not tell the remaining TTL of an item, so it has to be configured.
+	TTL int
+}
+
+// readThrough reads the retrieval c from the old pool after the local pool
+// missed it. rsp is left as a miss if the old pool does not answer. The
+// value is copied to the server of the key for the client connection b.
+func (m *Migration) readThrough(b *backend, c *call, rsp *response) {
+	req := request{opcode: c.opcode, key: c.key}
+	if err := m.old.roundTrip(&req, rsp); err != nil {
+		applog.Warningf("Failed to read %q from old pool: %s", c.key, err)
+		rsp.init(c.opcode)
+		rsp.status = KEY_ENOENT
+		return
+	}
+	if rsp.status != SUCCESS {
+		return
+	}
+
+	addr, err := b.server(c.key)
+	if err != nil {
+		applog.Warningf("Failed to backfill %q: %s", c.key, err)
+		return
+	}
+	// ADD never overwrites a value written to the local pool meanwhile.
+	fill := newStorageRequest(ADD, c.key, rsp.value, rsp.flags, m.TTL)
+	go func() {
+		var rsp response
+		if err := m.local.roundTripTo(addr, fill, &rsp); err != nil {
+			applog.Warningf("Failed to backfill %q: %s", fill.key, err)
+		}
+	}()
+}
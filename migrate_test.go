@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMigration(t *testing.T) {
+	old, local := newFakeMemcached(t), newFakeMemcached(t)
+	defer old.Close()
+	defer local.Close()
+	old.items["foo"] = fakeItem{flags: 7, value: []byte("bar")}
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "new"}},
+		Pools: map[string]*PoolConfig{
+			"old": {Servers: []string{old.Addr()}},
+			"new": {Servers: []string{local.Addr()}, MigrateFrom: "old", MigrateTTL: 60},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pc := newConn(t, serveProxy(t, p.handlers["new"]))
+
+	// Misses of the local pool are read from the old one and copied.
+	if val, flags, _, err := pc.Get("foo"); err != nil || val != "bar" || flags != 7 {
+		t.Errorf("got %q, %d, %v, want bar, 7", val, flags, err)
+	}
+	if !waitItem(local, "foo") {
+		t.Error("value read from the old pool not copied")
+	}
+
+	// Writes go to both pools.
+	if err = pc.Set("dual", "baz", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*fakeMemcached{old, local} {
+		f.mu.Lock()
+		it, ok := f.items["dual"]
+		f.mu.Unlock()
+		if !ok || string(it.value) != "baz" {
+			t.Errorf("write not sent to %s", f.Addr())
+		}
+	}
+}
+
+func TestMigrationBackfillAdd(t *testing.T) {
+	old, local := newFakeMemcached(t), newFakeMemcached(t)
+	defer old.Close()
+	defer local.Close()
+	old.items["foo"] = fakeItem{value: []byte("old")}
+	old.items["bar"] = fakeItem{value: []byte("old")}
+	// Written to the local pool while foo was read from the old one.
+	local.items["foo"] = fakeItem{value: []byte("new")}
+
+	m := &Migration{
+		old:   newPoolClient(t, old.Addr(), DefaultPoolOptions),
+		local: newPoolClient(t, local.Addr(), DefaultPoolOptions),
+		TTL:   60,
+	}
+	for _, key := range []string{"foo", "bar"} {
+		var rsp response
+		m.readThrough(newBackend(m.local), &call{opcode: GET, key: []byte(key)}, &rsp)
+		if rsp.status != SUCCESS || string(rsp.value) != "old" {
+			t.Errorf("%s: got %s %q, want old", key, rsp.status, rsp.value)
+		}
+	}
+	if !waitItem(local, "bar") {
+		t.Fatal("bar not copied")
+	}
+	// The backfill of foo may still be in flight.
+	time.Sleep(10 * time.Millisecond)
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if it := local.items["foo"]; string(it.value) != "new" {
+		t.Errorf("backfill overwrote foo with %q", it.value)
+	}
+}
+
+func TestMigrationReadWrites(t *testing.T) {
+	old, f1, f2 := newFakeMemcached(t), newFakeMemcached(t), newFakeMemcached(t)
+	defer old.Close()
+	defer f1.Close()
+	defer f2.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "new"}},
+		Pools: map[string]*PoolConfig{
+			"old": {Servers: []string{old.Addr()}},
+			"new": {Servers: []string{f1.Addr(), f2.Addr()}, MigrateFrom: "old", MigrateTTL: 60},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pc := newConn(t, serveProxy(t, p.handlers["new"]))
+
+	// Servers are picked at random, a client reads the values it wrote or
+	// read through from the server they were copied to, not from the old
+	// pool.
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("migrate%d", i)
+		if err = pc.Set(key, "bar", 0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		old.mu.Lock()
+		delete(old.items, key)
+		old.mu.Unlock()
+		if val, _, _, err := pc.Get(key); err != nil || val != "bar" {
+			t.Fatalf("got %q, %v for written %s, want bar", val, err, key)
+		}
+	}
+	local := f1
+	f1.mu.Lock()
+	if _, ok := f1.items["migrate0"]; !ok {
+		local = f2
+	}
+	f1.mu.Unlock()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("through%d", i)
+		old.mu.Lock()
+		old.items[key] = fakeItem{value: []byte("baz")}
+		old.mu.Unlock()
+		pc.Get(key)
+		if !waitItem(local, key) {
+			t.Fatalf("%s not copied to %s", key, local.Addr())
+		}
+		old.mu.Lock()
+		delete(old.items, key)
+		old.mu.Unlock()
+		if val, _, _, err := pc.Get(key); err != nil || val != "baz" {
+			t.Fatalf("got %q, %v for %s read through, want baz", val, err, key)
+		}
+	}
+}
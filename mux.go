@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+const muxQueueSize = 4096
+
+var errMuxClosed = errors.New("memcache: connection is closed")
+
+// Mux pipelines the requests of all client connections over a fixed number
+// of connections per server. Responses are read in order and handed back
+// to the calls waiting for them.
+type Mux struct {
+	client *Client
+	size   int
+	next   uint32
+
+	mu    sync.Mutex
+	conns map[string][]*muxConn
+}
+
+func NewMux(client *Client, size int) *Mux {
+	return &Mux{
+		client: client,
+		size:   size,
+		conns:  make(map[string][]*muxConn),
+	}
+}
+
+// Close closes the shared connections. Calls still pending on them fail.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, conns := range m.conns {
+		for _, mc := range conns {
+			if mc != nil {
+				mc.fail(ErrClientClosed)
+				go mc.shutdown()
+			}
+		}
+	}
+	return nil
+}
+
+// retire closes the connections to removed servers. Calls still pending
+// on them fail.
+func (m *Mux) retire(removed []net.Addr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, addr := range removed {
+		for _, mc := range m.conns[addr.String()] {
+			if mc != nil {
+				mc.fail(ErrServerRemoved)
+				go mc.shutdown()
+			}
+		}
+		delete(m.conns, addr.String())
+	}
+}
+
+// slot returns the index of the connections to each server that a client
+// connection sends all its requests on, so that they are answered in the
+// order they were sent.
+func (m *Mux) slot() int {
+	return int(atomic.AddUint32(&m.next, 1) % uint32(m.size))
+}
+
+// send writes req to the connection to addr in slot. c.done is closed
+// once the response is in c.rsp or c.err.
+func (m *Mux) send(addr net.Addr, slot int, req *request, c *call) error {
+	return m.pick(addr, slot).send(req, c)
+}
+
+func (m *Mux) pick(addr net.Addr, slot int) *muxConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conns, ok := m.conns[addr.String()]
+	if !ok {
+		conns = make([]*muxConn, m.size)
+		m.conns[addr.String()] = conns
+	}
+	mc := conns[slot]
+	if mc == nil || mc.broken() != nil {
+		if mc != nil {
+			go mc.shutdown()
+		}
+		mc = &muxConn{
+			client:  m.client,
+			addr:    addr,
+			pending: make(chan *call, muxQueueSize),
+		}
+		conns[slot] = mc
+	}
+	return mc
+}
+
+// muxConn is a server connection shared by many client connections.
+type muxConn struct {
+	client *Client
+	addr   net.Addr
+
+	// Held while writing a request and queueing its call, so that the
+	// calls are queued in the order their requests were sent.
+	mu      sync.Mutex
+	pending chan *call
+	closed  bool
+
+	// Guards the connection, dialed on first use, and the error that
+	// broke it.
+	errMu sync.Mutex
+	cn    *conn
+	err   error
+}
+
+func (mc *muxConn) send(req *request, c *call) (err error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err = mc.broken(); err != nil {
+		mc.closePendingLocked()
+		return
+	}
+	// A call picked the connection before it was shut down.
+	if mc.closed {
+		return errMuxClosed
+	}
+	cn, err := mc.conn()
+	if err != nil {
+		return
+	}
+
+	rw := wrapVerbose(cn)
+	if err = req.WriteTo(rw); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		mc.fail(err)
+		mc.closePendingLocked()
+		return
+	}
+	c.backend = mc.addr.String()
+	c.done = make(chan struct{})
+	mc.pending <- c
+	return nil
+}
+
+// conn returns the connection to the server, dialing it and starting its
+// receiver on first use.
+func (mc *muxConn) conn() (cn *conn, err error) {
+	mc.errMu.Lock()
+	cn, err = mc.cn, mc.err
+	mc.errMu.Unlock()
+	if cn != nil || err != nil {
+		return
+	}
+	if cn, err = mc.client.getConn(mc.addr); err != nil {
+		return nil, err
+	}
+
+	mc.errMu.Lock()
+	defer mc.errMu.Unlock()
+	if mc.err != nil {
+		// Failed while dialing.
+		cn.Close()
+		return nil, mc.err
+	}
+	mc.cn = cn
+	go mc.receive(cn)
+	return cn, nil
+}
+
+func (mc *muxConn) receive(cn *conn) {
+	for c := range mc.pending {
+		rsp := new(response)
+		rsp.init(c.opcode)
+		err := mc.broken()
+		if err == nil {
+			cn.expect(c.opcode)
+			if err = rsp.ReadFrom(wrapVerbose(cn)); err != nil {
+				applog.Warningf("Failed to read response from %s: %s", mc.addr, err)
+				mc.fail(err)
+			}
+		}
+		c.rsp, c.err = rsp, err
+		c.received = time.Now()
+		close(c.done)
+	}
+	cn.Close()
+}
+
+// fail marks the connection as broken and closes it. Calls still pending
+// on it fail with the same error.
+func (mc *muxConn) fail(err error) {
+	mc.errMu.Lock()
+	defer mc.errMu.Unlock()
+	if mc.err == nil {
+		mc.err = err
+		if mc.cn != nil {
+			mc.cn.Close()
+		}
+	}
+}
+
+func (mc *muxConn) broken() error {
+	mc.errMu.Lock()
+	defer mc.errMu.Unlock()
+	return mc.err
+}
+
+// shutdown stops the receiver and closes the connection once the pending
+// calls are answered.
+func (mc *muxConn) shutdown() {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.closePendingLocked()
+}
+
+func (mc *muxConn) closePendingLocked() {
+	if !mc.closed {
+		mc.closed = true
+		close(mc.pending)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultNegativeCacheTTL      = time.Second
+	defaultNegativeCacheMaxBytes = 16 << 20
+)
+
+// NegativeCacheConfig answers the retrievals of keys that were just found
+// missing from the proxy.
+type NegativeCacheConfig struct {
+	// How long misses are served from the cache. Defaults to 1s.
+	TTL Duration `json:"ttl"`
+	// Memory used by the cache, least recently used keys are evicted
+	// beyond it. Defaults to 16MB.
+	MaxBytes int `json:"max_bytes"`
+}
+
+func (nc *NegativeCacheConfig) validate() error {
+	if nc.TTL < 0 {
+		return fmt.Errorf("negative cache: negative ttl")
+	}
+	if nc.MaxBytes < 0 {
+		return fmt.Errorf("negative cache: negative max_bytes")
+	}
+	return nil
+}
+
+// NegativeCache holds the keys that were found missing for a short time.
+type NegativeCache struct {
+	*localCache
+}
+
+func NewNegativeCache(nc *NegativeCacheConfig) *NegativeCache {
+	ttl, maxBytes := time.Duration(nc.TTL), nc.MaxBytes
+	if ttl == 0 {
+		ttl = defaultNegativeCacheTTL
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultNegativeCacheMaxBytes
+	}
+	return &NegativeCache{newLocalCache(KEY_ENOENT, ttl, maxBytes)}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "negcache"}},
+		Pools: map[string]*PoolConfig{"negcache": {
+			Servers:       []string{f.Addr()},
+			NegativeCache: &NegativeCacheConfig{TTL: Duration(time.Minute)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pc := newConn(t, serveProxy(t, p.handlers["negcache"]))
+
+	gets := f.Gets()
+	for i := 0; i < 3; i++ {
+		if _, _, _, err = pc.Get("missing"); err == nil {
+			t.Fatalf("got a value for a missing key")
+		}
+	}
+	if n := f.Gets() - gets; n != 1 {
+		t.Errorf("forwarded %d gets of a missing key, want 1", n)
+	}
+	if hits := atomic.LoadUint64(negativeCacheHits.with("negcache")); hits != 2 {
+		t.Errorf("got %d hits, want 2", hits)
+	}
+
+	if err = pc.Set("missing", "found", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _, err := pc.Get("missing"); err != nil || val != "found" {
+		t.Errorf("got %q, %v after set, want found", val, err)
+	}
+}
+
+func TestNegativeCacheWriteRace(t *testing.T) {
+	h := NewHandler(nil)
+	h.SetNegativeCache(NewNegativeCache(&NegativeCacheConfig{TTL: Duration(time.Minute)}))
+	key := []byte("foo")
+	set := newStorageRequest(SET, key, []byte("bar"), 0, 0)
+	get := &request{opcode: GET, key: key}
+	miss := &response{opcode: GET, status: KEY_ENOENT}
+
+	// A retrieval read after a write, but answered by the server before
+	// it, does not leave the miss in the cache.
+	h.lookup(set, &call{opcode: SET, key: key})
+	c := &call{opcode: GET, key: key, start: time.Now()}
+	if h.lookup(get, c) != nil || !c.fillMiss {
+		t.Fatalf("retrieval not marked to fill the cache")
+	}
+	h.updateCaches(c, miss)
+	h.updateCaches(&call{opcode: SET, key: key}, &response{opcode: SET, status: SUCCESS})
+	if rsp := h.lookup(get, &call{opcode: GET, key: key}); rsp != nil {
+		t.Errorf("got a miss cached before a write")
+	}
+
+	// Nor does one whose response is handled after the write's.
+	h.lookup(set, &call{opcode: SET, key: key})
+	c = &call{opcode: GET, key: key, start: time.Now()}
+	h.lookup(get, c)
+	h.updateCaches(&call{opcode: SET, key: key}, &response{opcode: SET, status: SUCCESS})
+	h.updateCaches(c, miss)
+	if rsp := h.lookup(get, &call{opcode: GET, key: key}); rsp != nil {
+		t.Errorf("got a miss read before a write")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// Proxy serves the listeners of a Config. Listeners forwarding to the same
+// pool share a handler.
+type Proxy struct {
+	// Held while changing servers. cfg is the configuration in effect.
+	mu  sync.Mutex
+	cfg *Config
+
+	servers  []*Server
+	handlers map[string]*MemcacheHandler
+	clients  map[string]*Client
+	files    []io.Closer
+	// Stopped on Close.
+	discoveries []*Discovery
+	admin       *Admin
+	accessLog   *AccessLog
+}
+
+// NewProxy creates the pools and handlers of cfg. No connection is opened
+// until Listen.
+func NewProxy(cfg *Config) (*Proxy, error) {
+	p := &Proxy{
+		cfg:      cfg,
+		handlers: make(map[string]*MemcacheHandler),
+		clients:  make(map[string]*Client),
+	}
+	if err := p.build(cfg); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Proxy) build(cfg *Config) (err error) {
+	var slowLog *SlowLog
+	if sc := cfg.SlowLog; sc != nil && sc.Threshold > 0 {
+		w, err := p.openLog(sc.File)
+		if err != nil {
+			return fmt.Errorf("Failed to open slow log: %s", err)
+		}
+		slowLog = NewSlowLog(time.Duration(sc.Threshold), sc.HashKeys, w)
+		applog.Infof("slow log: %v", time.Duration(sc.Threshold))
+	}
+	if ac := cfg.AccessLog; ac != nil {
+		w, err := p.openLog(ac.File)
+		if err != nil {
+			return fmt.Errorf("Failed to open access log: %s", err)
+		}
+		p.accessLog = NewAccessLog(ac, w)
+		p.files = append(p.files, p.accessLog)
+		applog.Infof("access log: %s (%v%%)", ac.File, ac.Rate)
+	}
+
+	for name, pc := range cfg.Pools {
+		if p.clients[name], err = pc.newClient(); err != nil {
+			return fmt.Errorf("Failed to create pool %s: %s", name, err)
+		}
+	}
+	for name, pc := range cfg.Pools {
+		if pc.Discovery != nil {
+			name := name
+			d := NewDiscovery(pc.Discovery, func(servers []string) error {
+				return p.setServers(name, servers)
+			})
+			applog.Infof("pool %s: discover %s", name, pc.Discovery.name())
+			p.discoveries = append(p.discoveries, d)
+			d.Start()
+		}
+	}
+	var limiter *ConnLimiter
+	if cc := cfg.ConnLimits; cc != nil {
+		limiter = NewConnLimiter(cc)
+		applog.Infof("conn limits: %d, %d per ip", cc.MaxConns, cc.MaxConnsPerIP)
+	}
+	for _, lc := range cfg.Listeners {
+		h, ok := p.handlers[lc.Pool]
+		if !ok {
+			if h, err = p.newHandler(lc.Pool, cfg.Pools[lc.Pool]); err != nil {
+				return err
+			}
+			if slowLog != nil {
+				h.SetSlowLog(slowLog)
+			}
+			if p.accessLog != nil {
+				h.SetAccessLog(p.accessLog)
+			}
+			p.handlers[lc.Pool] = h
+		}
+		srv := &Server{
+			Addr:         lc.Addr,
+			Handler:      h,
+			ReadTimeout:  clientRead,
+			WriteTimeout: clientWrite,
+			IdleTimeout:  clientIdle,
+			Limiter:      limiter,
+		}
+		if lc.ReadTimeout != 0 {
+			srv.ReadTimeout = time.Duration(lc.ReadTimeout)
+		}
+		if lc.WriteTimeout != 0 {
+			srv.WriteTimeout = time.Duration(lc.WriteTimeout)
+		}
+		if lc.IdleTimeout != 0 {
+			srv.IdleTimeout = time.Duration(lc.IdleTimeout)
+		}
+		if len(lc.Users) > 0 {
+			srv.Auth = &Auth{Users: lc.Users}
+		}
+		if lc.TLS != nil {
+			if srv.TLSConfig, err = newServerTLS(lc.TLS); err != nil {
+				return fmt.Errorf("listener %s: %s", lc.Addr, err)
+			}
+			applog.Infof("listen: %s over TLS", lc.Addr)
+		}
+		if lc.Socket != nil {
+			if srv.Socket, err = newSocketOptions(lc.Socket); err != nil {
+				return fmt.Errorf("listener %s: %s", lc.Addr, err)
+			}
+		}
+		p.servers = append(p.servers, srv)
+		applog.Infof("listen: %s -> pool %s", lc.Addr, lc.Pool)
+	}
+	return nil
+}
+
+func (p *Proxy) newHandler(name string, pc *PoolConfig) (*MemcacheHandler, error) {
+	h := NewHandler(p.clients[name])
+	h.Name = name
+	applog.Infof("pool %s: %q (hash %q)", name, pc.Servers, pc.Hash)
+	if pc.Mux > 0 {
+		h.SetMux(pc.Mux)
+		applog.Infof("pool %s: mux %d connections per remote", name, pc.Mux)
+	}
+	if pc.RateLimits != nil {
+		h.SetRateLimits(NewRateLimits(pc.RateLimits))
+		applog.Infof("pool %s: rate limits", name)
+	}
+	if pc.Coalesce {
+		h.SetCoalescing()
+		applog.Infof("pool %s: coalesce retrievals", name)
+	}
+	for _, fb := range pc.Fallback {
+		h.SetFallback(p.clients[fb])
+		applog.Infof("pool %s: fallback %s", name, fb)
+	}
+	if len(pc.Replicas) > 0 {
+		ack := AckFirst
+		if pc.Ack != "" {
+			ack, _ = ParseAckMode(pc.Ack)
+		}
+		replicas := make([]*Replica, len(pc.Replicas))
+		for i, r := range pc.Replicas {
+			replicas[i] = NewReplica(r, p.clients[r])
+		}
+		h.SetReplicas(ack, replicas)
+		applog.Infof("pool %s: replicas %q (ack %s)", name, pc.Replicas, ack)
+	}
+	if pc.MigrateFrom != "" {
+		ttl := pc.MigrateTTL
+		if ttl == 0 {
+			ttl = migrateTTL
+		}
+		h.SetMigration(p.clients[pc.MigrateFrom], ttl)
+		applog.Infof("pool %s: migrate from %s (ttl %d)", name, pc.MigrateFrom, ttl)
+	}
+	if pc.Shadow != "" {
+		w, err := p.openLog(pc.ShadowLog)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open shadow log: %s", err)
+		}
+		rate := pc.ShadowRate
+		if rate == 0 {
+			rate = shadowRate
+		}
+		h.SetShadow(NewShadow(p.clients[pc.Shadow], rate, w))
+		applog.Infof("pool %s: shadow %s (%v%%)", name, pc.Shadow, rate)
+	}
+	if pc.HotKeys > 0 {
+		h.SetHotKeys(NewHotKeys(pc.HotKeys, time.Duration(pc.HotKeysWindow)))
+		applog.Infof("pool %s: track %d hot keys", name, pc.HotKeys)
+	}
+	if pc.HotCache != nil {
+		h.SetHotCache(NewHotCache(pc.HotCache))
+		applog.Infof("pool %s: cache hot keys for %v", name, h.cache.ttl)
+	}
+	if pc.NegativeCache != nil {
+		h.SetNegativeCache(NewNegativeCache(pc.NegativeCache))
+		applog.Infof("pool %s: cache misses for %v", name, h.misses.ttl)
+	}
+	return h, nil
+}
+
+// openLog opens the log file name for appending, or returns stderr if name
+// is empty. The file is closed with p.
+func (p *Proxy) openLog(name string) (io.Writer, error) {
+	if name == "" {
+		return os.Stderr, nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p.files = append(p.files, f)
+	return f, nil
+}
+
+// poolNames returns the names of the pools, sorted. p.mu must be held.
+func (p *Proxy) poolNames() []string {
+	var names []string
+	for name := range p.cfg.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Listen opens the listeners and serves them in the background.
+func (p *Proxy) Listen() error {
+	for _, srv := range p.servers {
+		l, err := srv.listen()
+		if err != nil {
+			return fmt.Errorf("Failed to listen on %s: %s", srv.Addr, err)
+		}
+		go srv.serve(l)
+	}
+	return nil
+}
+
+// Shutdown drains the connections of all listeners at once. See
+// Server.Shutdown.
+func (p *Proxy) Shutdown(ctx context.Context) (err error) {
+	errs := make(chan error, len(p.servers))
+	for _, srv := range p.servers {
+		go func(srv *Server) {
+			errs <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	for range p.servers {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// ListenAdmin serves the admin API on addr. reload is called to reload the
+// configuration.
+func (p *Proxy) ListenAdmin(addr string, reload func() error) error {
+	a := NewAdmin(p, reload)
+	if err := a.Listen(addr); err != nil {
+		return fmt.Errorf("Failed to listen on %s: %s", addr, err)
+	}
+	p.admin = a
+	applog.Infof("admin: %s", addr)
+	return nil
+}
+
+// Upgrade passes the listeners to a new process. See Upgrade.
+func (p *Proxy) Upgrade() (*os.Process, error) {
+	var listeners []upgradable
+	for _, srv := range p.servers {
+		listeners = append(listeners, srv)
+	}
+	if p.admin != nil {
+		listeners = append(listeners, p.admin)
+	}
+	return Upgrade(listeners...)
+}
+
+// Close closes the connections to all pools.
+func (p *Proxy) Close() error {
+	if p.admin != nil {
+		p.admin.Close()
+	}
+	for _, d := range p.discoveries {
+		d.Close()
+	}
+	for _, h := range p.handlers {
+		h.Close()
+	}
+	for _, c := range p.clients {
+		if c != nil {
+			c.Close()
+		}
+	}
+	// Logs are closed before the files they write to.
+	for i := len(p.files) - 1; i >= 0; i-- {
+		p.files[i].Close()
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Buckets refilled to their burst are forgotten at this interval.
+const rateLimitSweepInterval = time.Minute
+
+// RateConfig is a token bucket: Rate requests per second, with bursts of
+// up to Burst requests. Burst defaults to Rate, and at least 1.
+type RateConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+func (rc *RateConfig) validate() error {
+	if rc.Rate <= 0 {
+		return fmt.Errorf("rate %v must be positive", rc.Rate)
+	}
+	if rc.Burst != 0 && rc.Burst < 1 {
+		return fmt.Errorf("burst %v must be at least 1", rc.Burst)
+	}
+	return nil
+}
+
+// PrefixRateConfig limits the requests for the keys starting with Prefix,
+// whichever client sends them.
+type PrefixRateConfig struct {
+	Prefix string `json:"prefix"`
+	RateConfig
+}
+
+// RateLimitsConfig limits the requests a pool accepts. Requests beyond the
+// limit of their client IP or user are answered with EBUSY, the ones
+// beyond the limit of their key prefix with ETMPFAIL.
+type RateLimitsConfig struct {
+	PerIP   *RateConfig `json:"per_ip"`
+	PerUser *RateConfig `json:"per_user"`
+	// Only the longest prefix matching a key applies.
+	Prefixes []*PrefixRateConfig `json:"prefixes"`
+}
+
+func (rc *RateLimitsConfig) validate() error {
+	if rc.PerIP != nil {
+		if err := rc.PerIP.validate(); err != nil {
+			return fmt.Errorf("rate limit per ip: %s", err)
+		}
+	}
+	if rc.PerUser != nil {
+		if err := rc.PerUser.validate(); err != nil {
+			return fmt.Errorf("rate limit per user: %s", err)
+		}
+	}
+	prefixes := make(map[string]bool)
+	for _, pc := range rc.Prefixes {
+		if pc.Prefix == "" {
+			return fmt.Errorf("rate limit without prefix")
+		}
+		if prefixes[pc.Prefix] {
+			return fmt.Errorf("rate limit of prefix %q: duplicate prefix", pc.Prefix)
+		}
+		prefixes[pc.Prefix] = true
+		if err := pc.validate(); err != nil {
+			return fmt.Errorf("rate limit of prefix %q: %s", pc.Prefix, err)
+		}
+	}
+	return nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter holds a token bucket per client or prefix.
+type limiter struct {
+	rate, burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newLimiter(rc *RateConfig) *limiter {
+	l := &limiter{
+		rate:    rc.Rate,
+		burst:   rc.Burst,
+		buckets: make(map[string]*bucket),
+	}
+	if l.burst == 0 {
+		l.burst = math.Max(l.rate, 1)
+	}
+	return l
+}
+
+// allow takes a token from the bucket of id if there is one left.
+func (l *limiter) allow(id string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= rateLimitSweepInterval {
+		for id, b := range l.buckets {
+			if l.refill(b, now) >= l.burst {
+				delete(l.buckets, id)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[id] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+type prefixLimiter struct {
+	prefix string
+	*limiter
+}
+
+// RateLimits enforces the limits of a pool on its requests.
+type RateLimits struct {
+	perIP    *limiter
+	perUser  *limiter
+	prefixes []prefixLimiter
+}
+
+func NewRateLimits(rc *RateLimitsConfig) *RateLimits {
+	rl := new(RateLimits)
+	if rc.PerIP != nil {
+		rl.perIP = newLimiter(rc.PerIP)
+	}
+	if rc.PerUser != nil {
+		rl.perUser = newLimiter(rc.PerUser)
+	}
+	for _, pc := range rc.Prefixes {
+		rl.prefixes = append(rl.prefixes, prefixLimiter{pc.Prefix, newLimiter(&pc.RateConfig)})
+	}
+	return rl
+}
+
+// check takes a token for a request for key from c. If there is none
+// left, it returns the status to answer with and the limit exceeded.
+func (rl *RateLimits) check(c *Conn, key []byte, now time.Time) (status Status, limit string) {
+	if rl.perIP != nil {
+		if !rl.perIP.allow(remoteIP(c.remoteAddr), now) {
+			return EBUSY, "ip"
+		}
+	}
+	if rl.perUser != nil && c.user != "" && !rl.perUser.allow(c.user, now) {
+		return EBUSY, "user"
+	}
+	if p := rl.match(key); p != nil && !p.allow(p.prefix, now) {
+		return ETMPFAIL, "prefix"
+	}
+	return SUCCESS, ""
+}
+
+// match returns the limiter of the longest prefix of key, if any.
+func (rl *RateLimits) match(key []byte) *prefixLimiter {
+	var longest *prefixLimiter
+	for i := range rl.prefixes {
+		p := &rl.prefixes[i]
+		n := len(p.prefix)
+		if len(key) >= n && string(key[:n]) == p.prefix && (longest == nil || n > len(longest.prefix)) {
+			longest = p
+		}
+	}
+	return longest
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(&RateConfig{Rate: 10, Burst: 2})
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow("a", now); got != want {
+			t.Errorf("request %d allowed: %v, want %v", i, got, want)
+		}
+	}
+	if !l.allow("b", now) {
+		t.Errorf("limited another client")
+	}
+	// A token is added every 100ms.
+	if !l.allow("a", now.Add(100*time.Millisecond)) || l.allow("a", now.Add(100*time.Millisecond)) {
+		t.Errorf("bucket not refilled at the rate")
+	}
+	l.allow("a", now.Add(rateLimitSweepInterval))
+	if len(l.buckets) != 1 {
+		t.Errorf("got %d buckets after sweeping, want 1", len(l.buckets))
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "ratelimit"}},
+		Pools: map[string]*PoolConfig{"ratelimit": {
+			Servers: []string{f.Addr()},
+			RateLimits: &RateLimitsConfig{
+				Prefixes: []*PrefixRateConfig{
+					{"batch:", RateConfig{Rate: 0.001, Burst: 2}},
+					{"batch:urgent:", RateConfig{Rate: 1000}},
+				},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pc := newConn(t, serveProxy(t, p.handlers["ratelimit"]))
+
+	for i := 0; i < 2; i++ {
+		if err = pc.Set("batch:foo", "bar", 0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = pc.Set("batch:foo", "bar", 0, 0, 0); err == nil {
+		t.Errorf("request beyond the limit was accepted")
+	}
+	if err = pc.Set("batch:urgent:foo", "bar", 0, 0, 0); err != nil {
+		t.Errorf("longer prefix was limited: %s", err)
+	}
+	if err = pc.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Errorf("key without limit was limited: %s", err)
+	}
+	if n := atomic.LoadUint64(throttledTotal.with("ratelimit", "prefix")); n != 1 {
+		t.Errorf("throttled %d requests, want 1", n)
+	}
+}
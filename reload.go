@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"time"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// Reload applies the server lists and hashes of the pools in cfg. Clients
+// stay connected; idle connections to removed servers are closed and the
+// ones in use are closed when released. Other changes need a restart and
+// are only logged. Nothing is applied if a server list fails to resolve.
+// The servers of pools using discovery are left to it.
+func (p *Proxy) Reload(cfg *Config) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !reflect.DeepEqual(p.cfg.Listeners, cfg.Listeners) {
+		applog.Warningf("Listener changes need a restart")
+	}
+
+	var swaps []*serverSwap
+	for name, pc := range cfg.Pools {
+		old, ok := p.cfg.Pools[name]
+		if !ok {
+			applog.Warningf("pool %s: new pools need a restart", name)
+			continue
+		}
+		if !samePoolRouting(old, pc) {
+			applog.Warningf("pool %s: changes other than servers and hash need a restart", name)
+		}
+		servers := pc.Servers
+		if old.Discovery != nil {
+			servers = old.Servers
+		}
+		if old.Hash == pc.Hash && reflect.DeepEqual(old.Servers, servers) {
+			continue
+		}
+		s, err := p.prepareSwap(name, pc.Hash, servers)
+		if err != nil {
+			return err
+		}
+		swaps = append(swaps, s)
+	}
+	for name := range p.cfg.Pools {
+		if _, ok := cfg.Pools[name]; !ok {
+			applog.Warningf("pool %s: removed pools need a restart", name)
+		}
+	}
+
+	for _, s := range swaps {
+		p.applySwap(s)
+	}
+	return nil
+}
+
+// setServers replaces the servers of the named pool.
+func (p *Proxy) setServers(name string, servers []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.setServersLocked(name, servers)
+}
+
+func (p *Proxy) setServersLocked(name string, servers []string) error {
+	s, err := p.prepareSwap(name, p.cfg.Pools[name].Hash, servers)
+	if err != nil {
+		return err
+	}
+	p.applySwap(s)
+	return nil
+}
+
+// serverSwap is a new selector for a pool, ready to be applied.
+type serverSwap struct {
+	name    string
+	hash    string
+	servers []string
+	ss      ServerSelector
+	removed []net.Addr
+}
+
+func (p *Proxy) prepareSwap(name, hash string, servers []string) (*serverSwap, error) {
+	ss, err := NewSelector(hash)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %s", name, err)
+	}
+	if err = ss.SetServers(servers); err != nil {
+		return nil, fmt.Errorf("pool %s: %s", name, err)
+	}
+	old := p.cfg.Pools[name]
+	added, removed := diffServers(old.Servers, servers)
+	removedAddrs, err := resolveServers(removed)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %s", name, err)
+	}
+	if old.Hash != hash {
+		applog.Infof("pool %s: hash %q -> %q", name, old.Hash, hash)
+	}
+	applog.Infof("pool %s: added %q, removed %q", name, added, removed)
+	return &serverSwap{name, hash, servers, ss, removedAddrs}, nil
+}
+
+func (p *Proxy) applySwap(s *serverSwap) {
+	p.clients[s.name].SetSelector(s.ss, s.removed)
+	if h, ok := p.handlers[s.name]; ok && h.mux != nil {
+		h.mux.retire(s.removed)
+	}
+	pc := p.cfg.Pools[s.name]
+	pc.Servers = s.servers
+	pc.Hash = s.hash
+}
+
+// samePoolRouting tells whether a and b differ only in servers and hash.
+func samePoolRouting(a, b *PoolConfig) bool {
+	x, y := *a, *b
+	x.Servers, y.Servers = nil, nil
+	x.Hash, y.Hash = "", ""
+	return reflect.DeepEqual(x, y)
+}
+
+func diffServers(old, cur []string) (added, removed []string) {
+	in := func(s string, list []string) bool {
+		for _, v := range list {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range cur {
+		if !in(s, old) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range old {
+		if !in(s, cur) {
+			removed = append(removed, s)
+		}
+	}
+	return
+}
+
+// watchConfig calls reload whenever the modification time of the file
+// name changes, checking every interval.
+func watchConfig(name string, interval time.Duration, reload func() error) {
+	var mtime time.Time
+	if fi, err := os.Stat(name); err == nil {
+		mtime = fi.ModTime()
+	}
+	for range time.Tick(interval) {
+		fi, err := os.Stat(name)
+		if err != nil {
+			applog.Warningf("Failed to stat config: %s", err)
+			continue
+		}
+		if !fi.ModTime().Equal(mtime) {
+			mtime = fi.ModTime()
+			applog.Infof("Config %s changed", name)
+			reload()
+		}
+	}
+}
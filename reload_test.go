@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProxyReload(t *testing.T) {
+	f1 := newFakeMemcached(t)
+	defer f1.Close()
+	f2 := newFakeMemcached(t)
+	defer f2.Close()
+
+	cfg := &Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "a"}},
+		Pools:     map[string]*PoolConfig{"a": {Servers: []string{f1.Addr()}}},
+	}
+	p, err := NewProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	client := p.clients["a"]
+
+	cn, err := client.PickConn("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.release()
+
+	err = p.Reload(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "a"}},
+		Pools:     map[string]*PoolConfig{"a": {Servers: []string{f2.Addr()}, Hash: "ketama"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := client.pickServer("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != f2.Addr() {
+		t.Errorf("picked %s, want %s", addr, f2.Addr())
+	}
+	client.mu.Lock()
+	idle := len(client.freeconn[f1.Addr()])
+	client.mu.Unlock()
+	if idle != 0 {
+		t.Errorf("got %d idle connections to the removed server, want 0", idle)
+	}
+	if !cn.closed {
+		t.Error("connection to the removed server was not closed")
+	}
+
+	// A pool that fails to resolve leaves everything unchanged.
+	err = p.Reload(&Config{
+		Listeners: cfg.Listeners,
+		Pools:     map[string]*PoolConfig{"a": {Servers: []string{"bad:address:1"}}},
+	})
+	if err == nil {
+		t.Error("reloaded an unresolvable server")
+	}
+	if addr, _ = client.pickServer("foo"); addr.String() != f2.Addr() {
+		t.Errorf("picked %s after a failed reload, want %s", addr, f2.Addr())
+	}
+}
+
+func TestReloadRemovedServer(t *testing.T) {
+	f1 := newFakeMemcached(t)
+	defer f1.Close()
+	f2 := newFakeMemcached(t)
+	defer f2.Close()
+
+	cfg := &Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "a"}},
+		Pools:     map[string]*PoolConfig{"a": {Servers: []string{f1.Addr()}}},
+	}
+	p, err := NewProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	client := p.clients["a"]
+	pc := newConn(t, serveProxy(t, p.handlers["a"]))
+	if err = pc.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Reload(&Config{
+		Listeners: cfg.Listeners,
+		Pools:     map[string]*PoolConfig{"a": {Servers: []string{f2.Addr()}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A client connection leaves the removed server it was sending to.
+	if err = pc.Set("foo", "baz", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	f2.mu.Lock()
+	it, ok := f2.items["foo"]
+	f2.mu.Unlock()
+	if !ok || string(it.value) != "baz" {
+		t.Errorf("got %q, %v on the new server, want baz", it.value, ok)
+	}
+
+	// Connections opened to a removed server are still closed when
+	// released.
+	addrs, err := resolveServers([]string{f1.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn, err := client.getConn(addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.release()
+	if st := client.Stats(addrs[0]); !st.Retired || st.Idle != 0 {
+		t.Errorf("got %+v for the removed server, want it retired", st)
+	}
+}
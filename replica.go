@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// AckMode decides how many pools must acknowledge a replicated write
+// before it is answered.
+type AckMode int
+
+const (
+	AckFirst AckMode = iota
+	AckQuorum
+	AckAll
+)
+
+var ackModeNames = map[AckMode]string{
+	AckFirst:  "first",
+	AckQuorum: "quorum",
+	AckAll:    "all",
+}
+
+func (m AckMode) String() string {
+	if name, ok := ackModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("AckMode(%d)", int(m))
+}
+
+func ParseAckMode(s string) (AckMode, error) {
+	for m, name := range ackModeNames {
+		if name == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown ack mode %q", s)
+}
+
+// acks returns the number of acknowledgements needed out of n pools.
+func (m AckMode) acks(n int) int {
+	switch m {
+	case AckQuorum:
+		return n/2 + 1
+	case AckAll:
+		return n
+	}
+	return 1
+}
+
+// Replica is a pool that receives a copy of every write.
+type Replica struct {
+	Name   string
+	client *Client
+
+	writes uint64
+	errors uint64
+}
+
+func NewReplica(name string, client *Client) *Replica {
+	return &Replica{
+		Name:   name,
+		client: client,
+	}
+}
+
+// Writes returns the number of writes sent to the replica.
+func (r *Replica) Writes() uint64 {
+	return atomic.LoadUint64(&r.writes)
+}
+
+// Errors returns the number of writes the replica failed to answer.
+func (r *Replica) Errors() uint64 {
+	return atomic.LoadUint64(&r.errors)
+}
+
+// ReplicaSet routes writes to all of its pools.
+type ReplicaSet struct {
+	Ack      AckMode
+	replicas []*Replica
+}
+
+func NewReplicaSet(ack AckMode, replicas []*Replica) *ReplicaSet {
+	return &ReplicaSet{
+		Ack:      ack,
+		replicas: replicas,
+	}
+}
+
+type replicaResult struct {
+	i   int
+	rsp *response
+}
+
+// Write sends req to every pool and returns a response once enough pools
+// have answered, preferring the response of the earliest pool in the set.
+// Pools that are still busy finish in the background. If the ack mode can
+// not be satisfied the write fails with ETMPFAIL. The first pool, the local
+// one, is written on the server addr, and local is called once it has
+// answered, if it is not nil.
+func (rs *ReplicaSet) Write(req *request, addr net.Addr, local func()) *response {
+	n := len(rs.replicas)
+	results := make(chan replicaResult, n)
+	for i, r := range rs.replicas {
+		go func(i int, r *Replica) {
+			atomic.AddUint64(&r.writes, 1)
+			rsp := new(response)
+			var err error
+			if i == 0 {
+				err = r.client.roundTripTo(addr, req, rsp)
+			} else {
+				err = r.client.roundTrip(req, rsp)
+			}
+			if err != nil {
+				atomic.AddUint64(&r.errors, 1)
+				applog.Warningf("Failed to write %q to replica %s: %s", req.key, r.Name, err)
+				rsp = nil
+			}
+			if i == 0 && local != nil {
+				local()
+			}
+			results <- replicaResult{i, rsp}
+		}(i, r)
+	}
+
+	need := rs.Ack.acks(n)
+	var best replicaResult
+	acked, failed := 0, 0
+	for acked < need && failed <= n-need {
+		res := <-results
+		if res.rsp == nil {
+			failed++
+			continue
+		}
+		if best.rsp == nil || res.i < best.i {
+			best = res
+		}
+		acked++
+	}
+	if acked < need {
+		applog.Warningf("Write %q acknowledged by %d of %d replicas (ack %s)", req.key, acked, n, rs.Ack)
+		rsp := new(response)
+		rsp.init(req.opcode)
+		rsp.status = ETMPFAIL
+		return rsp
+	}
+	return best.rsp
+}
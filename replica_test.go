@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReplicaSetWrite(t *testing.T) {
+	up := []*fakeMemcached{newFakeMemcached(t), newFakeMemcached(t)}
+	for _, f := range up {
+		defer f.Close()
+	}
+	// Nothing listens on the address of a closed listener.
+	l := newListener(t)
+	down := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		ack     AckMode
+		servers []string
+		status  Status
+	}{
+		{AckFirst, []string{down, up[0].Addr()}, SUCCESS},
+		{AckFirst, []string{down, down}, ETMPFAIL},
+		{AckQuorum, []string{up[0].Addr(), up[1].Addr(), down}, SUCCESS},
+		{AckQuorum, []string{up[0].Addr(), down, down}, ETMPFAIL},
+		{AckAll, []string{up[0].Addr(), up[1].Addr()}, SUCCESS},
+		{AckAll, []string{up[0].Addr(), down}, ETMPFAIL},
+	}
+	for i, test := range tests {
+		var replicas []*Replica
+		for j, addr := range test.servers {
+			replicas = append(replicas, NewReplica(fmt.Sprint(j), newPoolClient(t, addr, DefaultPoolOptions)))
+		}
+		rs := NewReplicaSet(test.ack, replicas)
+		addr, err := replicas[0].client.pickServer("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("replica%d", i)
+		local := make(chan bool, 1)
+		rsp := rs.Write(newStorageRequest(SET, []byte(key), []byte("bar"), 0, 0), addr, func() { local <- true })
+		if rsp.status != test.status {
+			t.Errorf("%s %q: got %s, want %s", test.ack, test.servers, rsp.status, test.status)
+		}
+		<-local
+		if test.ack == AckAll && test.status == SUCCESS {
+			for _, f := range up {
+				f.mu.Lock()
+				_, ok := f.items[key]
+				f.mu.Unlock()
+				if !ok {
+					t.Errorf("%s not written to %s", key, f.Addr())
+				}
+			}
+		}
+	}
+}
+
+func TestReplicaReadWrites(t *testing.T) {
+	f1, f2, replica := newFakeMemcached(t), newFakeMemcached(t), newFakeMemcached(t)
+	defer f1.Close()
+	defer f2.Close()
+	defer replica.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "a"}},
+		Pools: map[string]*PoolConfig{
+			"a":       {Servers: []string{f1.Addr(), f2.Addr()}, Replicas: []string{"replica"}},
+			"replica": {Servers: []string{replica.Addr()}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pc := newConn(t, serveProxy(t, p.handlers["a"]))
+	// Servers are picked at random, a client reads from the one its
+	// writes went to.
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("replica%d", i)
+		if err = pc.Set(key, "bar", 0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if val, _, _, err := pc.Get(key); err != nil || val != "bar" {
+			t.Fatalf("got %q, %v for %s, want bar", val, err, key)
+		}
+	}
+}
@@ -33,9 +33,30 @@ type request struct {
 	bodyLen  int
 	opaque   uint32
 	cas      uint64
-	body     io.Reader
+	extras   []byte
+	key      []byte
+	value    []byte
+	body     []byte
 	hdrBytes [24]byte
-	tmp      [4]byte
+}
+
+// newStorageRequest builds a storage request such as SET or ADD.
+func newStorageRequest(opcode CommandCode, key, value []byte, flags, expire int) *request {
+	r := &request{
+		opcode:   opcode,
+		keyLen:   len(key),
+		extraLen: 8,
+		bodyLen:  8 + len(key) + len(value),
+	}
+	r.body = make([]byte, r.bodyLen)
+	binary.BigEndian.PutUint32(r.body, uint32(flags))
+	binary.BigEndian.PutUint32(r.body[4:], uint32(expire))
+	copy(r.body[8:], key)
+	copy(r.body[8+len(key):], value)
+	r.extras = r.body[:8]
+	r.key = r.body[8 : 8+len(key)]
+	r.value = r.body[8+len(key):]
+	return r
 }
 
 func (r *request) ReadFrom(from ReadWriter) (err error) {
@@ -60,15 +81,39 @@ func (r *request) readCommand(from ReadWriter) (err error) {
 	r.opaque = binary.BigEndian.Uint32(hdr[12:])
 	r.cas = binary.BigEndian.Uint64(hdr[16:])
 
+	if r.keyLen+r.extraLen > r.bodyLen {
+		return fmt.Errorf("Failed to read request: BodyLen %d is smaller than key and extras", r.bodyLen)
+	}
 	if (r.bodyLen - r.keyLen - r.extraLen) > MaxBodyLen {
 		return fmt.Errorf("Failed to read request: BodyLen %d is too big (max %d)", r.bodyLen, MaxBodyLen)
 	}
 
-	r.body = from
+	// The body is read in full so that the request can be replayed
+	// against another server.
+	if cap(r.body) < r.bodyLen {
+		r.body = make([]byte, r.bodyLen)
+	}
+	r.body = r.body[:r.bodyLen]
+	if _, err = io.ReadFull(from, r.body); err != nil {
+		return
+	}
+	r.extras = r.body[:r.extraLen]
+	r.key = r.body[r.extraLen : r.extraLen+r.keyLen]
+	r.value = r.body[r.extraLen+r.keyLen:]
 
 	return nil
 }
 
+// clone returns a copy of r that stays valid after r is reused.
+func (r *request) clone() *request {
+	c := *r
+	c.body = append([]byte(nil), r.body...)
+	c.extras = c.body[:r.extraLen]
+	c.key = c.body[r.extraLen : r.extraLen+r.keyLen]
+	c.value = c.body[r.extraLen+r.keyLen:]
+	return &c
+}
+
 // Storage commands
 // ----------------
 // First, the client sends a command line which looks like this:
@@ -111,7 +156,7 @@ func (r *request) writeRetrieval(to ReadWriter) (err error) {
 	if _, err = fmt.Fprintf(to, "%s ", CommandNames[r.opcode]); err != nil {
 		return
 	}
-	if _, err = io.CopyN(to, r.body, int64(r.keyLen)); err != nil {
+	if _, err = to.Write(r.key); err != nil {
 		return
 	}
 	if _, err = to.Write(crlf); err != nil {
@@ -121,35 +166,26 @@ func (r *request) writeRetrieval(to ReadWriter) (err error) {
 }
 
 func (r *request) writeStorage(to ReadWriter) (err error) {
-	// Read extra from request body
 	if r.extraLen != 8 {
 		return fmt.Errorf("Extra length %d is too small", r.extraLen)
 	}
-	tmp := r.tmp[:]
-	if _, err = io.ReadFull(r.body, tmp); err != nil {
-		return
-	}
-	flags := int(binary.BigEndian.Uint32(tmp))
-	if _, err = io.ReadFull(r.body, tmp); err != nil {
-		return
-	}
-	expire := int(binary.BigEndian.Uint32(tmp))
+	flags := int(binary.BigEndian.Uint32(r.extras))
+	expire := int(binary.BigEndian.Uint32(r.extras[4:]))
 
 	if _, err = fmt.Fprintf(to, "%s ", CommandNames[r.opcode]); err != nil {
 		return
 	}
 	// Write key
-	if _, err = io.CopyN(to, r.body, int64(r.keyLen)); err != nil {
+	if _, err = to.Write(r.key); err != nil {
 		return
 	}
 	// Write flags expire valuelen
 	// FIXME: noreply
-	vlen := r.bodyLen - r.extraLen - r.keyLen
-	if _, err = fmt.Fprintf(to, " %d %d %d\r\n", flags, expire, vlen); err != nil {
+	if _, err = fmt.Fprintf(to, " %d %d %d\r\n", flags, expire, len(r.value)); err != nil {
 		return
 	}
 	// Write value
-	if _, err = io.CopyN(to, r.body, int64(vlen)); err != nil {
+	if _, err = to.Write(r.value); err != nil {
 		return
 	}
 	if _, err = to.Write(crlf); err != nil {
@@ -162,7 +198,7 @@ func (r *request) writeDeletion(to ReadWriter) (err error) {
 	if _, err = fmt.Fprintf(to, "%s ", CommandNames[r.opcode]); err != nil {
 		return
 	}
-	if _, err = io.CopyN(to, r.body, int64(r.keyLen)); err != nil {
+	if _, err = to.Write(r.key); err != nil {
 		return
 	}
 	if _, err = to.Write(crlf); err != nil {
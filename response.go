@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"io/ioutil"
 )
 
 var (
@@ -48,7 +47,7 @@ type response struct {
 	flags  int
 	bytes  int
 	cas    int
-	data   io.Reader
+	value  []byte
 	status Status
 
 	hdrBytes [24]byte
@@ -61,7 +60,7 @@ func (r *response) init(opcode CommandCode) {
 	r.flags = 0
 	r.bytes = 0
 	r.cas = 0
-	r.data = nil
+	r.value = r.value[:0]
 	r.status = SUCCESS
 
 	hdr := r.hdrBytes[:]
@@ -72,6 +71,14 @@ func (r *response) init(opcode CommandCode) {
 	}
 }
 
+// clone returns a copy of r that stays valid after r is reused.
+func (r *response) clone() *response {
+	c := *r
+	c.key = append([]byte(nil), r.key...)
+	c.value = append([]byte(nil), r.value...)
+	return &c
+}
+
 func (r *response) ReadFrom(from ReadWriter) (err error) {
 	switch r.opcode {
 	case GET, GETQ, GETK, GETKQ:
@@ -129,7 +136,23 @@ func (r *response) readRetrieval(from ReadWriter) (err error) {
 		return fmt.Errorf("Unexpected get response: %q", line)
 	}
 
-	r.data = from
+	if r.bytes < 0 || r.bytes > MaxBodyLen {
+		return fmt.Errorf("Value length %d is out of range (max %d)", r.bytes, MaxBodyLen)
+	}
+
+	// Value followed by \r\nEND\r\n
+	n = r.bytes + len(crlf) + len(resultEnd)
+	if cap(r.value) < n {
+		r.value = make([]byte, n)
+	}
+	r.value = r.value[:n]
+	if _, err = io.ReadFull(from, r.value); err != nil {
+		return
+	}
+	if !bytes.Equal(r.value[r.bytes+len(crlf):], resultEnd) {
+		return fmt.Errorf("Unexpected end of get response: %q", r.value[r.bytes:])
+	}
+	r.value = r.value[:r.bytes]
 
 	return
 }
@@ -193,6 +216,8 @@ func (r *response) WriteTo(to ReadWriter) (err error) {
 		err = r.writeStorage(to)
 	case DELETE, DELETEQ:
 		err = r.writeDeletion(to)
+	case SASL_LIST_MECHS, SASL_AUTH, SASL_STEP:
+		err = r.writeValue(to)
 	default:
 		err = fmt.Errorf("Unsupported opcode %s", r.opcode)
 	}
@@ -244,11 +269,7 @@ func (r *response) writeRetrieval(to ReadWriter) (err error) {
 		}
 	}
 	// Value
-	if _, err = io.CopyN(to, r.data, int64(r.bytes)); err != nil {
-		return
-	}
-	// Discard the \r\nEND\r\n from reader
-	if _, err = io.CopyN(ioutil.Discard, r.data, 7); err != nil {
+	if _, err = to.Write(r.value); err != nil {
 		return
 	}
 
@@ -267,3 +288,14 @@ func (r *response) writeDeletion(to ReadWriter) (err error) {
 	_, err = to.Write(hdr)
 	return err
 }
+
+// writeValue writes a response whose body is just the value.
+func (r *response) writeValue(to ReadWriter) (err error) {
+	hdr := r.hdrBytes[:]
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(r.value)))
+	if _, err = to.Write(hdr); err != nil {
+		return
+	}
+	_, err = to.Write(r.value)
+	return
+}
@@ -2,25 +2,54 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.jumbo.ws/go/tcgl/applog"
 )
 
 type Server struct {
-	Addr           string
-	Handler        Handler
-	ReadTimeout    time.Duration
-	WriteTimeout   time.Duration
+	Addr    string
+	Handler Handler
+	// Maximum duration for reading the rest of a request once it started.
+	ReadTimeout time.Duration
+	// Maximum duration of each write of a response.
+	WriteTimeout time.Duration
+	// Maximum duration to wait for the next request. Idle connections
+	// are closed.
+	IdleTimeout    time.Duration
 	MaxHeaderBytes int
+	// Requires clients to authenticate with SASL PLAIN if set.
+	Auth *Auth
+	// Limits the client connections if set. It can be shared by servers.
+	Limiter *ConnLimiter
+	// Serves clients over TLS if set.
+	TLSConfig *tls.Config
+	// Applied to the socket file if Addr is a unix socket.
+	Socket *SocketOptions
+
+	inShutdown int32
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*Conn]struct{}
 }
 
+// ErrServerClosed is returned by ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("mproxy: Server closed")
+
+// How often Shutdown looks for connections that became idle.
+const shutdownPollInterval = 100 * time.Millisecond
+
 func (srv *Server) ListenAndServe() error {
 	l, err := srv.listen()
 	if err != nil {
@@ -31,8 +60,15 @@ func (srv *Server) ListenAndServe() error {
 
 func (srv *Server) listen() (l net.Listener, err error) {
 	addr := srv.Addr
-	if strings.Contains(addr, "/") {
-		return net.Listen("unix", addr)
+	if l, err = inheritedListener(addr); l != nil || err != nil {
+		// The socket file is now this process's to remove.
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		return
+	}
+	if isUnixAddr(addr) {
+		return srv.listenUnix(addr)
 	} else {
 		return net.Listen("tcp", addr)
 	}
@@ -40,10 +76,25 @@ func (srv *Server) listen() (l net.Listener, err error) {
 
 func (srv *Server) serve(l net.Listener) error {
 	defer l.Close()
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+	// The plain listener is tracked, to be passed on upgrades.
+	if srv.TLSConfig != nil {
+		l = tls.NewListener(l, srv.TLSConfig)
+	}
+
 	var tempDelay time.Duration
 	for {
+		if srv.Limiter != nil {
+			srv.Limiter.wait(srv.shuttingDown)
+		}
 		rw, e := l.Accept()
 		if e != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -62,11 +113,133 @@ func (srv *Server) serve(l net.Listener) error {
 		}
 		tempDelay = 0
 		c := srv.newConn(rw)
+		if srv.Limiter != nil {
+			if limit := srv.Limiter.acquire(c.remoteAddr); limit != "" {
+				go c.reject(limit)
+				continue
+			}
+			c.limited = true
+		}
+		if !srv.trackConn(c, true) {
+			c.close()
+			c.releaseLimit()
+			continue
+		}
 		go c.serve()
 		applog.Debugf("Accept connection from %s", c.remoteAddr)
 	}
 }
 
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.listeners[l] = struct{}{}
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+func (srv *Server) trackConn(c *Conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conns == nil {
+		srv.conns = make(map[*Conn]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.conns[c] = struct{}{}
+	} else {
+		delete(srv.conns, c)
+	}
+	return true
+}
+
+// numConns returns the number of open client connections.
+func (srv *Server) numConns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.conns)
+}
+
+func (srv *Server) listenAddr() string {
+	return srv.Addr
+}
+
+// listenerFile returns a copy of the file descriptor of the listener being
+// served, to be passed to another process.
+func (srv *Server) listenerFile() (*os.File, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for l := range srv.listeners {
+		return dupListener(l)
+	}
+	return nil, errors.New("no listener")
+}
+
+// dupListener returns a copy of the file descriptor of l. A unix socket is
+// no longer removed when l is closed.
+func dupListener(l net.Listener) (*os.File, error) {
+	switch l := l.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, fmt.Errorf("Unsupported listener %T", l)
+}
+
+// Shutdown stops accepting connections and waits for the open ones to
+// finish the request they are serving. Connections waiting for a request
+// are closed. If ctx expires first, its error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	for l := range srv.listeners {
+		l.Close()
+	}
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleConns() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns interrupts the connections waiting for a request and
+// tells whether all connections are closed.
+func (srv *Server) closeIdleConns() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.conns {
+		c.interruptIdle()
+	}
+	return len(srv.conns) == 0
+}
+
 const noLimit int64 = (1 << 63) - 1
 
 func (srv *Server) newConn(rwc net.Conn) (c *Conn) {
@@ -90,14 +263,68 @@ type Conn struct {
 	bufswr     *switchReader
 	bufsww     *switchWriter
 
+	// Whether some of the current request has been read. Written with
+	// mu held.
+	started bool
+
+	// The SASL user the client authenticated as, if any.
+	user string
+	// Whether the connection is counted by the server's limiter.
+	limited bool
+
 	mu sync.Mutex
 }
 
-func (c *Conn) Read(p []byte) (int, error) {
-	return c.buf.Reader.Read(p)
+// awaitRequest arms the idle timeout before reading the next request. It
+// returns false if the server is shutting down and no more requests should
+// be read.
+func (c *Conn) awaitRequest() bool {
+	if c.server.shuttingDown() {
+		return false
+	}
+	c.mu.Lock()
+	c.started = false
+	c.mu.Unlock()
+	c.setReadDeadline(c.server.IdleTimeout)
+	return true
+}
+
+// interruptIdle makes a pending read fail if no request is being read.
+func (c *Conn) interruptIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		c.rwc.SetReadDeadline(time.Unix(1, 0))
+	}
+}
+
+func (c *Conn) setReadDeadline(d time.Duration) {
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	c.rwc.SetReadDeadline(t)
+}
+
+func (c *Conn) extendWriteDeadline() {
+	if d := c.server.WriteTimeout; d > 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(d))
+	}
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	n, err = c.buf.Reader.Read(p)
+	if n > 0 && !c.started {
+		c.mu.Lock()
+		c.started = true
+		c.mu.Unlock()
+		c.setReadDeadline(c.server.ReadTimeout)
+	}
+	return
 }
 
 func (c *Conn) Write(p []byte) (int, error) {
+	c.extendWriteDeadline()
 	return c.buf.Writer.Write(p)
 }
 
@@ -106,6 +333,7 @@ func (c *Conn) WriteTo(w io.Writer) (int64, error) {
 }
 
 func (c *Conn) Flush() error {
+	c.extendWriteDeadline()
 	return c.buf.Flush()
 }
 
@@ -122,10 +350,16 @@ func (c *Conn) serve() {
 			buf = buf[:runtime.Stack(buf, false)]
 			applog.Warningf("panic serving %v: %v\n%s", c.remoteAddr, err, buf)
 		}
+		c.server.trackConn(c, false)
 		c.close() // FIXME: when to close the connection?
+		c.releaseLimit()
 		applog.Debugf("Close connection from %s", c.remoteAddr)
 	}()
 
+	if err := c.handshake(); err != nil {
+		applog.Warningf("TLS handshake with %s failed: %s", c.remoteAddr, err)
+		return
+	}
 	handler := c.server.Handler
 	handler.Serve(c)
 }
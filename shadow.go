@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+const (
+	shadowWorkers   = 8
+	shadowQueueSize = 1024
+)
+
+// Shadow mirrors a sample of the live traffic to another pool. Mirrored
+// requests are sent after the client has been answered and are dropped
+// when the shadow pool can not keep up, so it never adds latency.
+type Shadow struct {
+	client *Client
+	rate   float64
+	queue  chan *shadowCall
+	log    *log.Logger
+
+	// Held to queue requests, so that the queue is not closed meanwhile.
+	mu      sync.Mutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+type shadowCall struct {
+	req *request
+	rsp *response
+}
+
+// NewShadow mirrors percent of the requests to ss. Differences between the
+// primary and the shadow results of retrievals are logged to w.
+func NewShadow(client *Client, percent float64, w io.Writer) *Shadow {
+	s := &Shadow{
+		client: client,
+		rate:   percent / 100,
+		queue:  make(chan *shadowCall, shadowQueueSize),
+		log:    log.New(w, "", log.LstdFlags),
+	}
+	s.workers.Add(shadowWorkers)
+	for i := 0; i < shadowWorkers; i++ {
+		go s.run()
+	}
+	return s
+}
+
+// Close stops mirroring and waits for the requests already queued to be
+// sent. It does not close the client.
+func (s *Shadow) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	s.workers.Wait()
+	return nil
+}
+
+func (s *Shadow) sample() bool {
+	return rand.Float64() < s.rate
+}
+
+// mirror queues req for the shadow pool. rsp is the primary's response and
+// is only kept for retrievals.
+func (s *Shadow) mirror(req *request, rsp *response) {
+	sc := &shadowCall{req: req}
+	if req.opcode.IsRetrieval() {
+		sc.rsp = rsp.clone()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- sc:
+	default:
+		applog.Debugf("Shadow queue is full, dropping %s %q", req.opcode, req.key)
+	}
+}
+
+func (s *Shadow) run() {
+	defer s.workers.Done()
+	var rsp response
+	for sc := range s.queue {
+		if err := s.client.roundTrip(sc.req, &rsp); err != nil {
+			applog.Debugf("Failed to mirror %s %q: %s", sc.req.opcode, sc.req.key, err)
+			continue
+		}
+		if sc.rsp != nil {
+			s.compare(sc.req, sc.rsp, &rsp)
+		}
+	}
+}
+
+func (s *Shadow) compare(req *request, primary, shadow *response) {
+	switch {
+	case primary.status != shadow.status:
+		s.log.Printf("%s %q: status %q != %q", req.opcode, req.key, primary.status, shadow.status)
+	case primary.flags != shadow.flags:
+		s.log.Printf("%s %q: flags %d != %d", req.opcode, req.key, primary.flags, shadow.flags)
+	case !bytes.Equal(primary.value, shadow.value):
+		s.log.Printf("%s %q: value differs (%d != %d bytes)", req.opcode, req.key, len(primary.value), len(shadow.value))
+	}
+}
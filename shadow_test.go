@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitItem waits for f to store key and tells whether it did.
+func waitItem(f *fakeMemcached, key string) bool {
+	for i := 0; i < 1000; i++ {
+		f.mu.Lock()
+		_, ok := f.items[key]
+		f.mu.Unlock()
+		if ok {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestShadowAuth(t *testing.T) {
+	primary, shadow := newFakeMemcached(t), newFakeMemcached(t)
+	defer primary.Close()
+	defer shadow.Close()
+
+	h := NewHandler(newPoolClient(t, primary.Addr(), DefaultPoolOptions))
+	h.SetShadow(NewShadow(newPoolClient(t, shadow.Addr(), DefaultPoolOptions), 100, ioutil.Discard))
+	s := Server{
+		Addr:    "127.0.0.1:0",
+		Handler: h,
+		Auth:    &Auth{Users: map[string]string{"user": "secret"}},
+	}
+	l, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(l)
+
+	// Only the requests sent to the primary pool are mirrored.
+	pc := newConn(t, l.Addr().String())
+	if err = pc.Set("early", "bar", 0, 0, 0); err == nil {
+		t.Error("unauthenticated set succeeded")
+	}
+	if err = pc.Auth("user", "secret"); err != nil {
+		t.Fatalf("Failed to authenticate: %s", err)
+	}
+	if err = pc.Set("late", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !waitItem(shadow, "late") {
+		t.Fatal("authenticated set not mirrored")
+	}
+	shadow.mu.Lock()
+	_, ok := shadow.items["early"]
+	shadow.mu.Unlock()
+	if ok {
+		t.Error("unauthenticated set mirrored")
+	}
+}
+
+func TestShadowSample(t *testing.T) {
+	for _, test := range []struct {
+		percent  float64
+		min, max int
+	}{{0, 0, 0}, {100, 1000, 1000}, {10, 50, 150}} {
+		s := &Shadow{rate: test.percent / 100}
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if s.sample() {
+				n++
+			}
+		}
+		if n < test.min || n > test.max {
+			t.Errorf("%v%%: sampled %d of 1000", test.percent, n)
+		}
+	}
+}
+
+func TestShadowCompare(t *testing.T) {
+	primary, shadow := newFakeMemcached(t), newFakeMemcached(t)
+	defer primary.Close()
+	defer shadow.Close()
+	primary.items["same"] = fakeItem{value: []byte("bar")}
+	primary.items["diff"] = fakeItem{value: []byte("bar")}
+	primary.items["gone"] = fakeItem{value: []byte("bar")}
+	shadow.items["same"] = fakeItem{value: []byte("bar")}
+	shadow.items["diff"] = fakeItem{value: []byte("baz")}
+
+	var buf lockedBuffer
+	h := NewHandler(newPoolClient(t, primary.Addr(), DefaultPoolOptions))
+	h.SetShadow(NewShadow(newPoolClient(t, shadow.Addr(), DefaultPoolOptions), 100, &buf))
+	pc := newConn(t, serveProxy(t, h))
+	for _, key := range []string{"same", "diff", "gone"} {
+		if val, _, _, err := pc.Get(key); err != nil || val != "bar" {
+			t.Errorf("got %q, %v from the primary, want bar", val, err)
+		}
+	}
+
+	want := []string{`"diff": value differs`, `"gone": status`}
+	logged := func() bool {
+		log := buf.String()
+		return strings.Contains(log, want[0]) && strings.Contains(log, want[1])
+	}
+	for i := 0; i < 1000 && (shadow.Gets() < 3 || !logged()); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	// The comparison of "same" may not be done yet.
+	time.Sleep(10 * time.Millisecond)
+	log := buf.String()
+	for _, w := range want {
+		if !strings.Contains(log, w) {
+			t.Errorf("missing %s in\n%s", w, log)
+		}
+	}
+	if strings.Contains(log, `"same"`) {
+		t.Errorf("logged a matching response:\n%s", log)
+	}
+}
+
+func TestShadowClose(t *testing.T) {
+	shadow := newFakeMemcached(t)
+	defer shadow.Close()
+
+	s := NewShadow(newPoolClient(t, shadow.Addr(), DefaultPoolOptions), 100, ioutil.Discard)
+	req := newStorageRequest(SET, []byte("foo"), []byte("bar"), 0, 0)
+	s.mirror(req, nil)
+	// The queued requests are sent before the workers stop.
+	s.Close()
+	shadow.mu.Lock()
+	_, ok := shadow.items["foo"]
+	shadow.mu.Unlock()
+	if !ok {
+		t.Error("queued request not sent before closing")
+	}
+	// Requests mirrored once closed are dropped.
+	s.mirror(req, nil)
+	s.Close()
+}
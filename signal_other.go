@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Upgrades need the listeners to be passed as file descriptors, which is
+// only supported on unix.
+var upgradeSignal os.Signal
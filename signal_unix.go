@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal makes the process start a new one that takes over its
+// listeners.
+var upgradeSignal os.Signal = syscall.SIGUSR2
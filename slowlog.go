@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// SlowLogConfig enables logging the requests slower than Threshold.
+type SlowLogConfig struct {
+	Threshold Duration `json:"threshold"`
+	// Defaults to stderr.
+	File string `json:"file"`
+	// Log a hash of the keys instead of the keys.
+	HashKeys bool `json:"hash_keys"`
+}
+
+// SlowLog logs the requests that took longer than a threshold from being
+// read to having their response flushed, with the time spent waiting for
+// the backend.
+type SlowLog struct {
+	threshold time.Duration
+	hashKeys  bool
+	log       *log.Logger
+}
+
+func NewSlowLog(threshold time.Duration, hashKeys bool, w io.Writer) *SlowLog {
+	return &SlowLog{
+		threshold: threshold,
+		hashKeys:  hashKeys,
+		log:       log.New(w, "", log.LstdFlags),
+	}
+}
+
+func (s *SlowLog) record(pool string, c *call, rsp *response, total time.Duration) {
+	if total < s.threshold {
+		return
+	}
+	key := string(c.key)
+	if s.hashKeys {
+		key = hashKey(c.key)
+	}
+	size := c.size
+	if c.opcode.IsRetrieval() {
+		size = len(rsp.value)
+	}
+	backend := c.backendTime()
+	s.log.Printf("pool=%s cmd=%s key=%q backend=%s size=%d total=%v proxy=%v backend_time=%v",
+		pool, c.opcode, key, c.backend, size, total, total-backend, backend)
+}
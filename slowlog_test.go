@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer written by the handler while the test
+// reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSlowLog(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+
+	var buf lockedBuffer
+	ss := new(ServerList)
+	ss.SetServers([]string{f.Addr()})
+	handler := NewMemcacheHandler(ss)
+	handler.SetSlowLog(NewSlowLog(0, true, &buf))
+	pc := newConn(t, serveProxy(t, handler))
+	if err := pc.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	pc.Get("foo")
+
+	// The request is logged after the response is flushed.
+	var lines []string
+	for i := 0; i < 100 && len(lines) < 2; i++ {
+		time.Sleep(time.Millisecond)
+		lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d slow log lines, want 2:\n%s", len(lines), buf.String())
+	}
+	for _, want := range []string{"cmd=set", "size=3", "backend=" + f.Addr(), "backend_time="} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("missing %s in %s", want, lines[0])
+		}
+	}
+	if strings.Contains(buf.String(), `"foo"`) {
+		t.Errorf("key was not hashed: %s", lines[0])
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// ServerTLSConfig serves a listener over TLS. The files are read again
+// when they change.
+type ServerTLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Verifies the certificates of the clients with these CAs. A client
+	// presenting a valid certificate is authenticated as its common name.
+	ClientCAFile string `json:"client_ca_file"`
+	// Refuses clients without a valid certificate.
+	RequireClientCert bool `json:"require_client_cert"`
+}
+
+func (tc *ServerTLSConfig) validate() error {
+	if tc.CertFile == "" || tc.KeyFile == "" {
+		return fmt.Errorf("tls: cert_file and key_file are required")
+	}
+	if tc.RequireClientCert && tc.ClientCAFile == "" {
+		return fmt.Errorf("tls: require_client_cert needs client_ca_file")
+	}
+	return nil
+}
+
+// serverTLS builds the TLS configuration of listeners from a
+// ServerTLSConfig, again whenever one of its files is modified.
+type serverTLS struct {
+	cfg *ServerTLSConfig
+
+	mu       sync.Mutex
+	conf     *tls.Config
+	modTimes []time.Time
+}
+
+// newServerTLS loads the files of tc and returns the TLS configuration of
+// a listener.
+func newServerTLS(tc *ServerTLSConfig) (*tls.Config, error) {
+	s := &serverTLS{cfg: tc}
+	if _, err := s.current(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.current()
+		},
+	}, nil
+}
+
+func (s *serverTLS) files() []string {
+	files := []string{s.cfg.CertFile, s.cfg.KeyFile}
+	if s.cfg.ClientCAFile != "" {
+		files = append(files, s.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// current returns the configuration of the current files. If they can not
+// be loaded, the previous one is kept.
+func (s *serverTLS) current() (*tls.Config, error) {
+	files := s.files()
+	modTimes := make([]time.Time, len(files))
+	for i, name := range files {
+		if fi, err := os.Stat(name); err == nil {
+			modTimes[i] = fi.ModTime()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conf != nil && sameTimes(modTimes, s.modTimes) {
+		return s.conf, nil
+	}
+	conf, err := s.load()
+	if err != nil {
+		if s.conf == nil {
+			return nil, err
+		}
+		applog.Warningf("Failed to reload TLS certificates: %s", err)
+		return s.conf, nil
+	}
+	if s.conf != nil {
+		applog.Infof("Reloaded TLS certificate %s", s.cfg.CertFile)
+	}
+	s.conf, s.modTimes = conf, modTimes
+	return conf, nil
+}
+
+func (s *serverTLS) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS certificate: %s", err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if s.cfg.ClientCAFile != "" {
+		if conf.ClientCAs, err = loadCertPool(s.cfg.ClientCAFile); err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.cfg.RequireClientCert {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return conf, nil
+}
+
+func sameTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadCertPool reads the PEM certificates of name.
+func loadCertPool(name string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA certificates: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No CA certificate found in %s", name)
+	}
+	return pool, nil
+}
+
+// ClientTLSConfig connects to the servers of a pool over TLS.
+type ClientTLSConfig struct {
+	// Verifies the certificates of the servers with these CAs instead of
+	// the system's.
+	CAFile string `json:"ca_file"`
+	// Certificate presented to the servers, if any.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Name the certificates of the servers are checked against. Defaults
+	// to the host each server is given as, before it is resolved.
+	ServerName string `json:"server_name"`
+	// Sessions kept to resume TLS with the servers. Defaults to 64, -1
+	// disables resumption.
+	SessionCacheSize int `json:"session_cache_size"`
+}
+
+const defaultTLSSessionCacheSize = 64
+
+func (tc *ClientTLSConfig) validate(servers []string) error {
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file go together")
+	}
+	for _, server := range servers {
+		if strings.Contains(server, "/") {
+			return fmt.Errorf("tls: unix socket %s not supported", server)
+		}
+	}
+	return nil
+}
+
+func newClientTLS(tc *ClientTLSConfig) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: tc.ServerName}
+	var err error
+	if tc.CAFile != "" {
+		if conf.RootCAs, err = loadCertPool(tc.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if tc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS certificate: %s", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	switch size := tc.SessionCacheSize; {
+	case size == 0:
+		conf.ClientSessionCache = tls.NewLRUClientSessionCache(defaultTLSSessionCacheSize)
+	case size > 0:
+		conf.ClientSessionCache = tls.NewLRUClientSessionCache(size)
+	}
+	return conf, nil
+}
+
+// handshake completes the TLS handshake of c, if it is served over TLS,
+// and authenticates it as the common name of its verified certificate.
+func (c *Conn) handshake() error {
+	tc, ok := c.rwc.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	timeout := c.server.ReadTimeout
+	if timeout == 0 {
+		timeout = c.server.IdleTimeout
+	}
+	c.setReadDeadline(timeout)
+	c.extendWriteDeadline()
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	if st := tc.ConnectionState(); len(st.VerifiedChains) > 0 {
+		c.user = certIdentity(st.VerifiedChains[0][0])
+	}
+	return nil
+}
+
+// certIdentity returns the common name of cert, or its first DNS name.
+func certIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" || len(cert.DNSNames) == 0 {
+		return cert.Subject.CommonName
+	}
+	return cert.DNSNames[0]
+}
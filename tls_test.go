@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{serial: 1}
+	var err error
+	if ca.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.pem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ca
+}
+
+// issue returns a certificate named cn and its key, in PEM. It is valid for
+// the DNS names given, or for 127.0.0.1 if there are none.
+func (ca *testCA) issue(t *testing.T, cn string, names ...string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if len(names) == 0 {
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// binaryGet sends a binary GET of key on c and returns the status of the
+// response.
+func binaryGet(c net.Conn, key string) (Status, error) {
+	req := make([]byte, HDR_LEN+len(key))
+	req[0] = REQ_MAGIC
+	req[1] = byte(GET)
+	binary.BigEndian.PutUint16(req[2:], uint16(len(key)))
+	binary.BigEndian.PutUint32(req[8:], uint32(len(key)))
+	copy(req[HDR_LEN:], key)
+	if _, err := c.Write(req); err != nil {
+		return 0, err
+	}
+	var hdr [HDR_LEN]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return 0, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(hdr[8:]))
+	if _, err := io.ReadFull(c, body); err != nil {
+		return 0, err
+	}
+	return Status(binary.BigEndian.Uint16(hdr[6:])), nil
+}
+
+func TestServerTLS(t *testing.T) {
+	f := newFakeMemcached(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "mproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "proxy")
+	clientCert, clientKey := ca.issue(t, "app")
+	writeFiles(t, dir, map[string][]byte{"ca.pem": ca.pem, "cert.pem": serverCert, "key.pem": serverKey})
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{
+			Addr: "127.0.0.1:0",
+			Pool: "tls",
+			// Clients with a certificate need no password.
+			Users: map[string]string{"app": "secret"},
+			TLS: &ServerTLSConfig{
+				CertFile:          filepath.Join(dir, "cert.pem"),
+				KeyFile:           filepath.Join(dir, "key.pem"),
+				ClientCAFile:      filepath.Join(dir, "ca.pem"),
+				RequireClientCert: true,
+			},
+		}},
+		Pools: map[string]*PoolConfig{"tls": {Servers: []string{f.Addr()}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	srv := p.servers[0]
+	l, err := srv.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve(l)
+	defer shutdown(srv)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cert, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(certs ...tls.Certificate) (*tls.Conn, error) {
+		return tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+	}
+
+	c, err := dial(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := binaryGet(c, "foo"); err != nil || status != KEY_ENOENT {
+		t.Errorf("got %s, %v, want %s", status, err, KEY_ENOENT)
+	}
+	c.Close()
+
+	if c, err = dial(); err == nil {
+		_, err = binaryGet(c, "foo")
+		c.Close()
+	}
+	if err == nil {
+		t.Errorf("served a client without certificate")
+	}
+
+	// A new certificate is served once its files change.
+	serverCert, serverKey = ca.issue(t, "reloaded")
+	writeFiles(t, dir, map[string][]byte{"cert.pem": serverCert, "key.pem": serverKey})
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "cert.pem"), later, later)
+	if c, err = dial(cert); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if cn := c.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "reloaded" {
+		t.Errorf("got certificate %q, want reloaded", cn)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	// The server is verified as the host it is given as.
+	serverCert, serverKey := ca.issue(t, "memcached", "localhost")
+	clientCert, clientKey := ca.issue(t, "proxy")
+	writeFiles(t, dir, map[string][]byte{"ca.pem": ca.pem, "cert.pem": clientCert, "key.pem": clientKey})
+	cert, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	f := &fakeMemcached{
+		l: tls.NewListener(newListener(t), &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    roots,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}),
+		items: make(map[string]fakeItem),
+	}
+	go f.serve()
+	defer f.Close()
+
+	p, err := NewProxy(&Config{
+		Listeners: []*ListenerConfig{{Addr: "127.0.0.1:0", Pool: "tls"}},
+		Pools: map[string]*PoolConfig{"tls": {
+			Servers: []string{strings.Replace(f.Addr(), "127.0.0.1", "localhost", 1)},
+			TLS: &ClientTLSConfig{
+				CAFile:   filepath.Join(dir, "ca.pem"),
+				CertFile: filepath.Join(dir, "cert.pem"),
+				KeyFile:  filepath.Join(dir, "key.pem"),
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	srv := p.servers[0]
+	l, err := srv.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve(l)
+	defer shutdown(srv)
+
+	c := newConn(t, l.Addr().String())
+	if err = c.Set("foo", "bar", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _, err := c.Get("foo"); err != nil || val != "bar" {
+		t.Errorf("got %q, %v, want bar", val, err)
+	}
+}
+
+func TestClientTLSConnectTimeout(t *testing.T) {
+	// The server accepts connections but never answers the handshake.
+	l := newListener(t)
+	defer l.Close()
+	go acceptAll(l, make(chan net.Conn, 8))
+
+	c := newPoolClient(t, l.Addr().String(), PoolOptions{MaxIdle: 1})
+	c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	c.Timeouts.Connect = 50 * time.Millisecond
+
+	start := time.Now()
+	if _, err := c.PickConn(""); err == nil {
+		t.Fatal("connected without a TLS handshake")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("gave up after %s, want about %s", d, c.Timeouts.Connect)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// UnixSocketConfig sets the permissions of the socket file of a listener
+// on a unix socket.
+type UnixSocketConfig struct {
+	// Octal permissions, e.g. "0660". Defaults to 0777 minus the umask.
+	Mode string `json:"mode"`
+	// User and group names or ids. Default to the ones of the process.
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+}
+
+func (sc *UnixSocketConfig) validate() error {
+	_, err := newSocketOptions(sc)
+	return err
+}
+
+// SocketOptions are applied to a socket file once it is bound.
+type SocketOptions struct {
+	// Left as is if 0.
+	Mode os.FileMode
+	// Left as is if -1.
+	UID, GID int
+}
+
+func newSocketOptions(sc *UnixSocketConfig) (*SocketOptions, error) {
+	opts := &SocketOptions{UID: -1, GID: -1}
+	if sc.Mode != "" {
+		mode, err := strconv.ParseUint(sc.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("socket: invalid mode %q", sc.Mode)
+		}
+		opts.Mode = os.FileMode(mode)
+	}
+	if sc.Owner != "" {
+		u, err := user.Lookup(sc.Owner)
+		if err != nil {
+			if u, err = user.LookupId(sc.Owner); err != nil {
+				return nil, fmt.Errorf("socket: unknown owner %q", sc.Owner)
+			}
+		}
+		opts.UID, _ = strconv.Atoi(u.Uid)
+	}
+	if sc.Group != "" {
+		g, err := user.LookupGroup(sc.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(sc.Group); err != nil {
+				return nil, fmt.Errorf("socket: unknown group %q", sc.Group)
+			}
+		}
+		opts.GID, _ = strconv.Atoi(g.Gid)
+	}
+	return opts, nil
+}
+
+// isUnixAddr tells whether a listener address is a unix socket: a path
+// containing a "/", or a Linux abstract socket name starting with "@".
+func isUnixAddr(addr string) bool {
+	return strings.Contains(addr, "/") || isAbstractAddr(addr)
+}
+
+// isAbstractAddr tells whether addr is in the abstract namespace, which
+// has no file.
+func isAbstractAddr(addr string) bool {
+	return strings.HasPrefix(addr, "@")
+}
+
+// validateUnixAddr checks a listener address and its socket options.
+func validateUnixAddr(addr string, sc *UnixSocketConfig) error {
+	if !isUnixAddr(addr) {
+		if sc != nil {
+			return fmt.Errorf("socket options need a unix socket")
+		}
+		return nil
+	}
+	if isAbstractAddr(addr) {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("abstract sockets are only supported on Linux")
+		}
+		if sc != nil {
+			return fmt.Errorf("abstract sockets have no permissions")
+		}
+		return nil
+	}
+	if sc != nil {
+		return sc.validate()
+	}
+	return nil
+}
+
+// How long to wait for a server on an existing socket file before it is
+// considered stale.
+const staleSocketTimeout = time.Second
+
+// listenUnix listens on the unix socket addr. A socket file left by a
+// process that did not close its listener is removed first. The file is
+// removed again when the listener is closed.
+func (srv *Server) listenUnix(addr string) (net.Listener, error) {
+	if !isAbstractAddr(addr) {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if srv.Socket != nil && !isAbstractAddr(addr) {
+		// Until then, the file is only writable, so connectable, by the
+		// user of the process.
+		if err = srv.Socket.apply(addr); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file name if no server accepts
+// connections on it. Other files are left for Listen to fail on.
+func removeStaleSocket(name string) error {
+	fi, err := os.Lstat(name)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	c, err := net.DialTimeout("unix", name, staleSocketTimeout)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another process", name)
+	}
+	if !isConnRefused(err) {
+		return nil
+	}
+	if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove stale socket: %s", err)
+	}
+	applog.Infof("Removed stale socket %s", name)
+	return nil
+}
+
+func isConnRefused(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok {
+			return se.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
+
+func (opts *SocketOptions) apply(name string) error {
+	if opts.Mode != 0 {
+		if err := os.Chmod(name, opts.Mode); err != nil {
+			return fmt.Errorf("Failed to set socket mode: %s", err)
+		}
+	}
+	if opts.UID != -1 || opts.GID != -1 {
+		if err := os.Chown(name, opts.UID, opts.GID); err != nil {
+			return fmt.Errorf("Failed to set socket owner: %s", err)
+		}
+	}
+	return nil
+}
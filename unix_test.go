@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func newUnixServer(addr, backend string) *Server {
+	ss := new(ServerList)
+	ss.SetServers([]string{backend})
+	return &Server{Addr: addr, Handler: NewMemcacheHandler(ss)}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "mproxy.sock")
+
+	// A process killed while listening leaves its socket file.
+	stale, err := net.Listen("unix", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	f := newFakeMemcached(t)
+	defer f.Close()
+	srv := newUnixServer(name, f.Addr())
+	srv.Socket = &SocketOptions{Mode: 0600, UID: -1, GID: -1}
+	l, err := srv.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve(l)
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("got mode %o, want 600", mode)
+	}
+
+	// The socket of a running server is left alone.
+	if l, err := newUnixServer(name, f.Addr()).listen(); err == nil {
+		l.Close()
+		t.Error("listened on a socket in use")
+	}
+
+	c, err := net.Dial("unix", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := binaryGet(c, "unix-missing"); err != nil || status != KEY_ENOENT {
+		t.Errorf("got %s, %v, want %s", status, err, KEY_ENOENT)
+	}
+	c.Close()
+
+	shutdown(srv)
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("socket file left after shutdown: %v", err)
+	}
+}
+
+func TestAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets need Linux")
+	}
+	f := newFakeMemcached(t)
+	defer f.Close()
+	srv := newUnixServer(fmt.Sprintf("@mproxy-test-%d", os.Getpid()), f.Addr())
+	l, err := srv.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve(l)
+	defer shutdown(srv)
+
+	c, err := net.Dial("unix", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if status, err := binaryGet(c, "unix-missing"); err != nil || status != KEY_ENOENT {
+		t.Errorf("got %s, %v, want %s", status, err, KEY_ENOENT)
+	}
+}
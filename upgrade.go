@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"git.jumbo.ws/go/tcgl/applog"
+)
+
+// listenAddrsEnv lists the addresses of the listeners a process inherits
+// from its parent during an upgrade, in the order of their file
+// descriptors starting at 3.
+const listenAddrsEnv = "MPROXY_LISTEN_ADDRS"
+
+// parentPidEnv is the pid of the process that started an upgrade, to be
+// told when the listeners are served.
+const parentPidEnv = "MPROXY_PARENT_PID"
+
+var (
+	inheritOnce sync.Once
+	inherited   map[string]*os.File
+)
+
+// inheritedListener returns the listener for addr passed by the parent
+// process, or nil if there is none.
+func inheritedListener(addr string) (net.Listener, error) {
+	inheritOnce.Do(func() {
+		inherited = make(map[string]*os.File)
+		if env := os.Getenv(listenAddrsEnv); env != "" {
+			for i, a := range strings.Split(env, ",") {
+				inherited[a] = os.NewFile(uintptr(3+i), a)
+			}
+		}
+	})
+	f, ok := inherited[addr]
+	if !ok {
+		return nil, nil
+	}
+	delete(inherited, addr)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// closeInherited closes the listeners passed by the parent process that no
+// listener of this one claimed, such as the ones removed from its config.
+func closeInherited() {
+	inheritOnce.Do(func() {})
+	for addr, f := range inherited {
+		applog.Infof("Close inherited listener %s, not configured", addr)
+		f.Close()
+		delete(inherited, addr)
+	}
+}
+
+// upgradable is a listener that can be passed to a new process.
+type upgradable interface {
+	listenAddr() string
+	listenerFile() (*os.File, error)
+}
+
+// Upgrade starts a new process of the binary found at the path the current
+// one was started with. It inherits the listeners and tells this process
+// to drain and exit once it serves them.
+func Upgrade(listeners ...upgradable) (*os.Process, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	var addrs []string
+	defer func() {
+		for _, f := range files[3:] {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		f, err := l.listenerFile()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to pass listener %s: %s", l.listenAddr(), err)
+		}
+		files = append(files, f)
+		addrs = append(addrs, l.listenAddr())
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, listenAddrsEnv+"=") && !strings.HasPrefix(kv, parentPidEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		listenAddrsEnv+"="+strings.Join(addrs, ","),
+		parentPidEnv+"="+strconv.Itoa(os.Getpid()))
+
+	return os.StartProcess(path, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+}
+
+// notifyParent tells the process the listeners were inherited from that
+// they are being served. Nothing is sent if it already exited and this
+// process was adopted by another one.
+func notifyParent() error {
+	if os.Getenv(listenAddrsEnv) == "" {
+		return nil
+	}
+	pid, err := strconv.Atoi(os.Getenv(parentPidEnv))
+	if err != nil {
+		return fmt.Errorf("Invalid %s: %q", parentPidEnv, os.Getenv(parentPidEnv))
+	}
+	if ppid := os.Getppid(); ppid != pid {
+		return fmt.Errorf("Parent process %d exited, now %d", pid, ppid)
+	}
+	parent, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return parent.Signal(syscall.SIGTERM)
+}
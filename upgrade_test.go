@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInheritListener(t *testing.T) {
+	backend := newFakeMemcached(t)
+	defer backend.Close()
+	ss := new(ServerList)
+	ss.SetServers([]string{backend.Addr()})
+	parent := &Server{Addr: "127.0.0.1:0", Handler: NewMemcacheHandler(ss)}
+	l, err := parent.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.Addr = l.Addr().String()
+	go parent.serve(l)
+	var f *os.File
+	for i := 0; i < 100; i++ {
+		if f, err = parent.listenerFile(); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	unclaimed, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As passed by Upgrade to the new process.
+	inheritedListener("")
+	inherited[parent.Addr] = f
+	inherited["127.0.0.1:1"] = unclaimed
+	shutdown(parent)
+
+	child := &Server{Addr: parent.Addr, Handler: NewMemcacheHandler(ss)}
+	if l, err = child.listen(); err != nil {
+		t.Fatal(err)
+	}
+	go child.serve(l)
+	defer shutdown(child)
+	c, err := net.Dial("tcp", child.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if status, err := binaryGet(c, "upgrade-missing"); err != nil || status != KEY_ENOENT {
+		t.Errorf("got %s, %v, want %s", status, err, KEY_ENOENT)
+	}
+
+	closeInherited()
+	if len(inherited) != 0 || unclaimed.Close() == nil {
+		t.Error("unclaimed listener left open")
+	}
+}
+
+func TestNotifyParent(t *testing.T) {
+	os.Setenv(listenAddrsEnv, "127.0.0.1:1")
+	defer os.Unsetenv(listenAddrsEnv)
+	// This process is not its own parent, so it must not be signaled.
+	os.Setenv(parentPidEnv, strconv.Itoa(os.Getpid()))
+	defer os.Unsetenv(parentPidEnv)
+	if err := notifyParent(); err == nil {
+		t.Error("notified a process other than the parent")
+	}
+}